@@ -0,0 +1,396 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fastwego/dingding"
+	"github.com/gin-gonic/gin"
+)
+
+// 审批实例状态
+const (
+	ApprovalRunning    = "RUNNING"
+	ApprovalAgreed     = "AGREED"
+	ApprovalRefused    = "REFUSED"
+	ApprovalTerminated = "TERMINATED"
+)
+
+// 审批任务状态
+const (
+	ApprovalTaskAssigned   = "ASSIGNED"
+	ApprovalTaskAgreed     = "AGREED"
+	ApprovalTaskRefused    = "REFUSED"
+	ApprovalTaskRedirected = "REDIRECTED"
+	ApprovalTaskCanceled   = "CANCELED"
+)
+
+// ApprovalInstance 审批实例
+type ApprovalInstance struct {
+	ProcessInstanceId string          `json:"process_instance_id"`
+	ProcessCode       string          `json:"process_code"`
+	Title             string          `json:"title"`
+	OriginatorUserid  string          `json:"originator_userid"`
+	Status            string          `json:"status"`
+	FormValues        json.RawMessage `json:"form_values"`
+	CreateTime        int64           `json:"create_time"`
+	FinishTime        int64           `json:"finish_time"`
+	UpdatedAt         int64           `json:"updated_at"`
+	Tasks             []ApprovalTask  `json:"tasks,omitempty"`
+}
+
+// ApprovalTask 审批任务
+type ApprovalTask struct {
+	StaffId    string `json:"staff_id"`
+	ActivityId string `json:"activity_id"`
+	Status     string `json:"status"`
+	Remark     string `json:"remark"`
+	CreateTime int64  `json:"create_time"`
+	FinishTime int64  `json:"finish_time"`
+}
+
+// ApprovalFilter 审批实例查询条件，空值不过滤
+type ApprovalFilter struct {
+	ProcessCode string
+	Originator  string
+	Status      string
+	Offset      int
+	Limit       int
+}
+
+const approvalSchema = `
+CREATE TABLE IF NOT EXISTS approval_instances (
+	process_instance_id TEXT PRIMARY KEY,
+	process_code        TEXT    NOT NULL DEFAULT '',
+	title               TEXT    NOT NULL DEFAULT '',
+	originator_userid   TEXT    NOT NULL DEFAULT '',
+	status              TEXT    NOT NULL,
+	form_values         TEXT    NOT NULL DEFAULT '[]',
+	create_time         INTEGER NOT NULL DEFAULT 0,
+	finish_time         INTEGER NOT NULL DEFAULT 0,
+	updated_at          INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS approval_instances_process_code ON approval_instances (process_code);
+CREATE INDEX IF NOT EXISTS approval_instances_originator ON approval_instances (originator_userid);
+CREATE INDEX IF NOT EXISTS approval_instances_status ON approval_instances (status);
+CREATE TABLE IF NOT EXISTS approval_tasks (
+	process_instance_id TEXT    NOT NULL,
+	staff_id            TEXT    NOT NULL,
+	create_time         INTEGER NOT NULL,
+	activity_id         TEXT    NOT NULL DEFAULT '',
+	status              TEXT    NOT NULL,
+	remark              TEXT    NOT NULL DEFAULT '',
+	finish_time         INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (process_instance_id, staff_id, create_time)
+);
+`
+
+// 实例状态机：RUNNING -> AGREED / REFUSED / TERMINATED，终态不再变化
+// 事件可能乱序到达（如 finish 先于 start），此时保持终态
+func nextApprovalStatus(current string, evt BpmsInstanceChangeEvent) (status string, ok bool) {
+	switch current {
+	case ApprovalAgreed, ApprovalRefused, ApprovalTerminated:
+		return current, false
+	}
+
+	switch evt.Type {
+	case "start":
+		// 任务事件可能先占位了 RUNNING，仍需补充表单内容
+		return ApprovalRunning, true
+	case "finish":
+		if evt.Result == "refuse" {
+			return ApprovalRefused, true
+		}
+		return ApprovalAgreed, true
+	case "terminate":
+		return ApprovalTerminated, true
+	}
+	return current, false
+}
+
+// 任务状态机：ASSIGNED -> AGREED / REFUSED / REDIRECTED / CANCELED
+func nextApprovalTaskStatus(current string, evt BpmsTaskChangeEvent) (status string, ok bool) {
+	if len(current) > 0 && current != ApprovalTaskAssigned {
+		return current, false
+	}
+
+	switch evt.Type {
+	case "start":
+		return ApprovalTaskAssigned, current != ApprovalTaskAssigned
+	case "finish":
+		switch evt.Result {
+		case "refuse":
+			return ApprovalTaskRefused, true
+		case "redirect":
+			return ApprovalTaskRedirected, true
+		default:
+			return ApprovalTaskAgreed, true
+		}
+	case "cancel":
+		return ApprovalTaskCanceled, true
+	}
+	return current, false
+}
+
+// Approvals 审批实例跟踪：由 bpms_instance_change / bpms_task_change 驱动，表单内容来自 processinstance/get
+type Approvals struct {
+	db     *sql.DB
+	client *dingding.Client
+}
+
+func NewApprovals(db *sql.DB, client *dingding.Client) (approvals *Approvals, err error) {
+	if _, err = db.Exec(approvalSchema); err != nil {
+		return
+	}
+	return &Approvals{db: db, client: client}, nil
+}
+
+// 审批实例详情
+type processInstanceDetail struct {
+	Title               string          `json:"title"`
+	OriginatorUserid    string          `json:"originator_userid"`
+	Status              string          `json:"status"`
+	Result              string          `json:"result"`
+	FormComponentValues json.RawMessage `json:"form_component_values"`
+}
+
+func (a *Approvals) fetch(processInstanceId string) (detail processInstanceDetail, err error) {
+	payload, err := json.Marshal(map[string]string{"process_instance_id": processInstanceId})
+	if err != nil {
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/topapi/processinstance/get", bytes.NewReader(payload))
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return
+	}
+
+	result := struct {
+		Errcode         int                   `json:"errcode"`
+		Errmsg          string                `json:"errmsg"`
+		ProcessInstance processInstanceDetail `json:"process_instance"`
+	}{}
+	if err = json.Unmarshal(resp, &result); err != nil {
+		return
+	}
+	if result.Errcode != 0 {
+		return detail, fmt.Errorf("processinstance/get: %d %s", result.Errcode, result.Errmsg)
+	}
+	return result.ProcessInstance, nil
+}
+
+func (a *Approvals) onInstanceChange(ctx context.Context, evt BpmsInstanceChangeEvent) (err error) {
+	var current string
+	err = a.db.QueryRow(`SELECT status FROM approval_instances WHERE process_instance_id = ?`, evt.ProcessInstanceId).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return
+	}
+
+	status, ok := nextApprovalStatus(current, evt)
+	if !ok {
+		log.Printf("approval %s ignore %s in status %s", evt.ProcessInstanceId, evt.Type, current)
+		return nil
+	}
+
+	// 补充表单内容与发起人
+	detail, err := a.fetch(evt.ProcessInstanceId)
+	if err != nil {
+		return
+	}
+	formValues := string(detail.FormComponentValues)
+	if len(formValues) == 0 || formValues == "null" {
+		formValues = "[]"
+	}
+	originator := detail.OriginatorUserid
+	if len(originator) == 0 && evt.Type == "start" {
+		originator = evt.StaffId
+	}
+
+	return a.saveInstance(evt, status, originator, formValues)
+}
+
+// 终态判断在 SQL 中完成：读取状态与写入之间隔着一次网络请求，
+// 多个 worker 并发处理同一实例的 start / finish 时，start 不能覆盖已写入的终态
+func (a *Approvals) saveInstance(evt BpmsInstanceChangeEvent, status string, originator string, formValues string) (err error) {
+	_, err = a.db.Exec(`INSERT INTO approval_instances
+		(process_instance_id, process_code, title, originator_userid, status, form_values, create_time, finish_time, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (process_instance_id) DO UPDATE SET
+			process_code = excluded.process_code, title = excluded.title, originator_userid = excluded.originator_userid,
+			status = CASE WHEN approval_instances.status IN ('AGREED', 'REFUSED', 'TERMINATED')
+				THEN approval_instances.status ELSE excluded.status END,
+			form_values = excluded.form_values,
+			create_time = MAX(approval_instances.create_time, excluded.create_time),
+			finish_time = MAX(approval_instances.finish_time, excluded.finish_time),
+			updated_at = excluded.updated_at`,
+		evt.ProcessInstanceId, evt.ProcessCode, evt.Title, originator, status, formValues,
+		evt.CreateTime, evt.FinishTime, time.Now().Unix())
+	return
+}
+
+func (a *Approvals) onTaskChange(ctx context.Context, evt BpmsTaskChangeEvent) (err error) {
+	var current string
+	err = a.db.QueryRow(`SELECT status FROM approval_tasks WHERE process_instance_id = ? AND staff_id = ? AND create_time = ?`,
+		evt.ProcessInstanceId, evt.StaffId, evt.CreateTime).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return
+	}
+
+	status, ok := nextApprovalTaskStatus(current, evt)
+	if !ok {
+		log.Printf("approval %s task %s ignore %s in status %s", evt.ProcessInstanceId, evt.StaffId, evt.Type, current)
+		return nil
+	}
+
+	// 任务事件可能先于实例事件到达，先占位实例
+	_, err = a.db.Exec(`INSERT OR IGNORE INTO approval_instances (process_instance_id, process_code, title, status, updated_at)
+		VALUES (?, ?, ?, ?, ?)`, evt.ProcessInstanceId, evt.ProcessCode, evt.Title, ApprovalRunning, time.Now().Unix())
+	if err != nil {
+		return
+	}
+
+	return a.saveTask(evt, status)
+}
+
+// 只有 ASSIGNED 的任务可以更新，并发事件不会覆盖已结束的任务
+func (a *Approvals) saveTask(evt BpmsTaskChangeEvent, status string) (err error) {
+	_, err = a.db.Exec(`INSERT INTO approval_tasks
+		(process_instance_id, staff_id, create_time, activity_id, status, remark, finish_time)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (process_instance_id, staff_id, create_time) DO UPDATE SET
+			activity_id = excluded.activity_id, status = excluded.status, remark = excluded.remark, finish_time = excluded.finish_time
+		WHERE approval_tasks.status = 'ASSIGNED'`,
+		evt.ProcessInstanceId, evt.StaffId, evt.CreateTime, evt.ActivityId, status, evt.Remark, evt.FinishTime)
+	return
+}
+
+// RegisterHandlers 注册审批事件处理
+func (a *Approvals) RegisterHandlers(dispatcher *EventDispatcher) {
+	On(dispatcher, "bpms_instance_change", a.onInstanceChange)
+	On(dispatcher, "bpms_task_change", a.onTaskChange)
+}
+
+const approvalColumns = `process_instance_id, process_code, title, originator_userid, status, form_values, create_time, finish_time, updated_at`
+
+func scanApproval(row interface{ Scan(...interface{}) error }) (instance ApprovalInstance, err error) {
+	var formValues string
+	err = row.Scan(&instance.ProcessInstanceId, &instance.ProcessCode, &instance.Title, &instance.OriginatorUserid,
+		&instance.Status, &formValues, &instance.CreateTime, &instance.FinishTime, &instance.UpdatedAt)
+	instance.FormValues = json.RawMessage(formValues)
+	return
+}
+
+// List 按条件查询审批实例，按发起时间倒序
+func (a *Approvals) List(filter ApprovalFilter) (instances []ApprovalInstance, err error) {
+	var where []string
+	var args []interface{}
+	if len(filter.ProcessCode) > 0 {
+		where = append(where, "process_code = ?")
+		args = append(args, filter.ProcessCode)
+	}
+	if len(filter.Originator) > 0 {
+		where = append(where, "originator_userid = ?")
+		args = append(args, filter.Originator)
+	}
+	if len(filter.Status) > 0 {
+		where = append(where, "status = ?")
+		args = append(args, strings.ToUpper(filter.Status))
+	}
+	if filter.Limit <= 0 || filter.Limit > 100 {
+		filter.Limit = 100
+	}
+
+	query := `SELECT ` + approvalColumns + ` FROM approval_instances`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY create_time DESC LIMIT ? OFFSET ?`
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	instances = []ApprovalInstance{}
+	for rows.Next() {
+		instance, err := scanApproval(rows)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, rows.Err()
+}
+
+// Get 审批实例及其任务
+func (a *Approvals) Get(processInstanceId string) (instance ApprovalInstance, err error) {
+	instance, err = scanApproval(a.db.QueryRow(`SELECT `+approvalColumns+` FROM approval_instances WHERE process_instance_id = ?`, processInstanceId))
+	if err == sql.ErrNoRows {
+		return instance, ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	rows, err := a.db.Query(`SELECT staff_id, activity_id, status, remark, create_time, finish_time FROM approval_tasks
+		WHERE process_instance_id = ? ORDER BY create_time`, processInstanceId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		task := ApprovalTask{}
+		err = rows.Scan(&task.StaffId, &task.ActivityId, &task.Status, &task.Remark, &task.CreateTime, &task.FinishTime)
+		if err != nil {
+			return
+		}
+		instance.Tasks = append(instance.Tasks, task)
+	}
+	return instance, rows.Err()
+}
+
+// RegisterRoutes 审批查询接口
+func (a *Approvals) RegisterRoutes(router gin.IRoutes) {
+	router.GET("/api/approvals", func(c *gin.Context) {
+		offset, _ := strconv.Atoi(c.Query("offset"))
+		limit, _ := strconv.Atoi(c.Query("limit"))
+		instances, err := a.List(ApprovalFilter{
+			ProcessCode: c.Query("process_code"),
+			Originator:  c.Query("originator"),
+			Status:      c.Query("status"),
+			Offset:      offset,
+			Limit:       limit,
+		})
+		queryResponse(c, instances, err)
+	})
+	router.GET("/api/approvals/:id", func(c *gin.Context) {
+		instance, err := a.Get(c.Param("id"))
+		queryResponse(c, instance, err)
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNextApprovalStatus(t *testing.T) {
+	tests := []struct {
+		current string
+		evt     BpmsInstanceChangeEvent
+		want    string
+		ok      bool
+	}{
+		{"", BpmsInstanceChangeEvent{Type: "start"}, ApprovalRunning, true},
+		{ApprovalRunning, BpmsInstanceChangeEvent{Type: "start"}, ApprovalRunning, true},
+		{ApprovalRunning, BpmsInstanceChangeEvent{Type: "finish", Result: "agree"}, ApprovalAgreed, true},
+		{ApprovalRunning, BpmsInstanceChangeEvent{Type: "finish", Result: "refuse"}, ApprovalRefused, true},
+		{ApprovalRunning, BpmsInstanceChangeEvent{Type: "terminate"}, ApprovalTerminated, true},
+		// finish 先于 start 到达
+		{"", BpmsInstanceChangeEvent{Type: "finish", Result: "agree"}, ApprovalAgreed, true},
+		{ApprovalAgreed, BpmsInstanceChangeEvent{Type: "start"}, ApprovalAgreed, false},
+		{ApprovalRefused, BpmsInstanceChangeEvent{Type: "finish", Result: "agree"}, ApprovalRefused, false},
+		{ApprovalTerminated, BpmsInstanceChangeEvent{Type: "start"}, ApprovalTerminated, false},
+		{ApprovalRunning, BpmsInstanceChangeEvent{Type: "unknown"}, ApprovalRunning, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := nextApprovalStatus(tt.current, tt.evt)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("nextApprovalStatus(%q, %s/%s) = %q, %v; want %q, %v",
+				tt.current, tt.evt.Type, tt.evt.Result, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNextApprovalTaskStatus(t *testing.T) {
+	tests := []struct {
+		current string
+		evt     BpmsTaskChangeEvent
+		want    string
+		ok      bool
+	}{
+		{"", BpmsTaskChangeEvent{Type: "start"}, ApprovalTaskAssigned, true},
+		{ApprovalTaskAssigned, BpmsTaskChangeEvent{Type: "start"}, ApprovalTaskAssigned, false},
+		{ApprovalTaskAssigned, BpmsTaskChangeEvent{Type: "finish", Result: "agree"}, ApprovalTaskAgreed, true},
+		{ApprovalTaskAssigned, BpmsTaskChangeEvent{Type: "finish", Result: "refuse"}, ApprovalTaskRefused, true},
+		{ApprovalTaskAssigned, BpmsTaskChangeEvent{Type: "finish", Result: "redirect"}, ApprovalTaskRedirected, true},
+		{ApprovalTaskAssigned, BpmsTaskChangeEvent{Type: "cancel"}, ApprovalTaskCanceled, true},
+		{"", BpmsTaskChangeEvent{Type: "finish", Result: "agree"}, ApprovalTaskAgreed, true},
+		{ApprovalTaskAgreed, BpmsTaskChangeEvent{Type: "start"}, ApprovalTaskAgreed, false},
+		{ApprovalTaskCanceled, BpmsTaskChangeEvent{Type: "finish"}, ApprovalTaskCanceled, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := nextApprovalTaskStatus(tt.current, tt.evt)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("nextApprovalTaskStatus(%q, %s/%s) = %q, %v; want %q, %v",
+				tt.current, tt.evt.Type, tt.evt.Result, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func newTestApprovals(t *testing.T) *Approvals {
+	db, err := openDB(filepath.Join(t.TempDir(), "approvals.db"))
+	if err != nil {
+		t.Skipf("sqlite unavailable: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	approvals, err := NewApprovals(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return approvals
+}
+
+// start 与 finish 并发处理时，start 在 finish 之后写入也不能覆盖终态
+func TestSaveInstanceKeepsTerminalStatus(t *testing.T) {
+	approvals := newTestApprovals(t)
+
+	evt := BpmsInstanceChangeEvent{ProcessInstanceId: "p1", Type: "finish", Result: "agree"}
+	if err := approvals.saveInstance(evt, ApprovalAgreed, "u1", "[]"); err != nil {
+		t.Fatal(err)
+	}
+	evt.Type = "start"
+	if err := approvals.saveInstance(evt, ApprovalRunning, "u1", `[{"name":"reason"}]`); err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := approvals.Get("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.Status != ApprovalAgreed {
+		t.Fatalf("status = %s, want %s", instance.Status, ApprovalAgreed)
+	}
+	if string(instance.FormValues) != `[{"name":"reason"}]` {
+		t.Fatalf("form values not updated: %s", instance.FormValues)
+	}
+}
+
+func TestSaveTaskKeepsFinishedStatus(t *testing.T) {
+	approvals := newTestApprovals(t)
+
+	evt := BpmsTaskChangeEvent{ProcessInstanceId: "p1", StaffId: "u1", CreateTime: 1, Type: "finish", Result: "refuse"}
+	if err := approvals.saveTask(evt, ApprovalTaskRefused); err != nil {
+		t.Fatal(err)
+	}
+	evt.Type = "start"
+	if err := approvals.saveTask(evt, ApprovalTaskAssigned); err != nil {
+		t.Fatal(err)
+	}
+
+	var status string
+	err := approvals.db.QueryRow(`SELECT status FROM approval_tasks WHERE process_instance_id = 'p1'`).Scan(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != ApprovalTaskRefused {
+		t.Fatalf("status = %s, want %s", status, ApprovalTaskRefused)
+	}
+}
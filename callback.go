@@ -15,41 +15,92 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 
-	"github.com/fastwego/dingding"
 	"github.com/gin-gonic/gin"
 )
 
-func Callback(c *gin.Context) {
+// 回调各阶段计数：received / success 及各失败阶段，通过 /admin/metrics 查看
+var callbackMetrics = expvar.NewMap("dingding_callback")
+
+// 回调失败：计数 + 记录阶段与原因，日志中不包含请求体与密钥
+func callbackFail(c *gin.Context, app string, status int, stage string, err error) {
+	callbackMetrics.Add(stage, 1)
+	log.Printf("callback failed app=%s stage=%s status=%d reason=%q", app, stage, status, err.Error())
+	c.AbortWithStatus(status)
+}
+
+// 回调签名：sha1(sort(token, timestamp, nonce, encrypt))
+func callbackSignature(token, timestamp, nonce, encrypt string) string {
+	items := []string{token, timestamp, nonce, encrypt}
+	sort.Strings(items)
+	sum := sha1.Sum([]byte(strings.Join(items, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Callback 事件回调：解密后写入事件队列 events
+func Callback(apps CallbackApps, events *EventQueue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		callback(c, apps, events)
+	}
+}
+
+func callback(c *gin.Context, apps CallbackApps, events *EventQueue) {
+
+	callbackMetrics.Add("received", 1)
+
+	// 按路径查找应用：/api/dingding/callback/:app，未指定时为默认应用
+	appName := c.Param("app")
+	if len(appName) == 0 {
+		appName = DefaultCallbackApp
+	}
+	app, ok := apps[appName]
+	if !ok {
+		callbackFail(c, appName, http.StatusNotFound, "unknown_app", errors.New("callback app not configured"))
+		return
+	}
 
 	// 加解密处理器
-	dingCrypto := dingding.NewCrypto(DingConfig["Token"], DingConfig["EncodingAESKey"], DingConfig["AppKey"])
+	dingCrypto := app.Crypto()
 
 	// Post Body
 	bytes, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
+		callbackFail(c, appName, http.StatusBadRequest, "read_body", err)
 		return
 	}
 
-	log.Printf(string(bytes))
-
 	msgJson := struct {
 		Encrypt string `json:"encrypt"`
 	}{}
 	err = json.Unmarshal(bytes, &msgJson)
 	if err != nil {
+		callbackFail(c, appName, http.StatusBadRequest, "unmarshal_body", err)
 		return
 	}
 
 	timestamp := c.Request.URL.Query().Get("timestamp")
 	nonce := c.Request.URL.Query().Get("nonce")
 	signature := c.Request.URL.Query().Get("signature")
+
+	// 先校验签名（只依赖 TOKEN），区分 伪造/TOKEN 配置错误 与 EncodingAESKey 配置错误
+	if callbackSignature(app.Token, timestamp, nonce, msgJson.Encrypt) != signature {
+		callbackFail(c, appName, http.StatusForbidden, "signature", errors.New("signature mismatch"))
+		return
+	}
+
 	decryptMsg, err := dingCrypto.GetDecryptMsg(timestamp, nonce, signature, msgJson.Encrypt)
 	if err != nil {
+		callbackFail(c, appName, http.StatusInternalServerError, "decrypt", err)
 		return
 	}
 
@@ -58,15 +109,25 @@ func Callback(c *gin.Context) {
 	}{}
 	err = json.Unmarshal(decryptMsg, &eventJson)
 	if err != nil {
+		callbackFail(c, appName, http.StatusBadRequest, "unmarshal_event", err)
 		return
 	}
 
 	switch eventJson.EventType {
+	case "check_url":
+		// 注册/更新回调地址时的校验事件，直接响应 success
 	default:
-		// 响应 success
-		encryptMsg := dingCrypto.GetEncryptMsg("success")
-		c.JSON(http.StatusOK, encryptMsg)
-
-		log.Println(encryptMsg)
+		// 写入事件队列后立即响应，由 worker 异步执行事件处理函数；写入失败不响应 success，由钉钉重试推送
+		err = events.Enqueue(app.Name, eventJson.EventType, decryptMsg)
+		if err != nil {
+			callbackFail(c, appName, http.StatusInternalServerError, "enqueue", err)
+			return
+		}
 	}
+
+	// 响应 success
+	encryptMsg := dingCrypto.GetEncryptMsg("success")
+	c.JSON(http.StatusOK, encryptMsg)
+
+	callbackMetrics.Add("success", 1)
 }
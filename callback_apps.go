@@ -0,0 +1,99 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/fastwego/dingding"
+	"github.com/spf13/viper"
+)
+
+// 默认应用，对应 /api/dingding/callback 与 DingConfig
+const DefaultCallbackApp = "default"
+
+// CallbackApp 一个应用的回调配置，回调地址 /api/dingding/callback/:app
+type CallbackApp struct {
+	Name           string
+	Token          string
+	EncodingAESKey string
+	AppKey         string
+
+	// 只处理该应用的事件
+	Dispatcher *EventDispatcher
+
+	cryptoOnce sync.Once
+	crypto     *dingding.Crypto
+}
+
+// Crypto 加解密处理器，首次使用时创建
+func (app *CallbackApp) Crypto() *dingding.Crypto {
+	app.cryptoOnce.Do(func() {
+		app.crypto = dingding.NewCrypto(app.Token, app.EncodingAESKey, app.AppKey)
+	})
+	return app.crypto
+}
+
+// CallbackApps 应用注册表，按应用名查找
+type CallbackApps map[string]*CallbackApp
+
+// 加载应用配置：默认应用来自 DingConfig，其余应用由 CallbackApps=hr,oa 指定，
+// 分别读取 APP_<NAME>_TOKEN / APP_<NAME>_ENCODINGAESKEY / APP_<NAME>_APPKEY
+func loadCallbackApps() CallbackApps {
+	apps := CallbackApps{
+		DefaultCallbackApp: {
+			Name:           DefaultCallbackApp,
+			Token:          DingConfig["Token"],
+			EncodingAESKey: DingConfig["EncodingAESKey"],
+			AppKey:         DingConfig["AppKey"],
+			Dispatcher:     DefaultDispatcher,
+		},
+	}
+
+	for _, name := range splitComma(viper.GetString("CallbackApps")) {
+		prefix := "APP_" + strings.ToUpper(name) + "_"
+		apps[name] = &CallbackApp{
+			Name:           name,
+			Token:          viper.GetString(prefix + "TOKEN"),
+			EncodingAESKey: viper.GetString(prefix + "ENCODINGAESKEY"),
+			AppKey:         viper.GetString(prefix + "APPKEY"),
+			Dispatcher:     NewEventDispatcher(),
+		}
+	}
+	return apps
+}
+
+// Dispatcher 事件队列按应用名查找分发器
+func (apps CallbackApps) Dispatcher(name string) *EventDispatcher {
+	if len(name) == 0 {
+		name = DefaultCallbackApp
+	}
+	app, ok := apps[name]
+	if !ok {
+		return nil
+	}
+	return app.Dispatcher
+}
+
+// OnAppEvent 注册应用 appName 的事件处理函数，应用未配置时 panic
+func OnAppEvent[T any](apps CallbackApps, appName string, eventType string, handler func(ctx context.Context, evt T) error) {
+	app, ok := apps[appName]
+	if !ok {
+		panic("callback app " + appName + " not configured")
+	}
+	On(app.Dispatcher, eventType, handler)
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCallbackAppsDispatcher(t *testing.T) {
+	hr := NewEventDispatcher()
+	apps := CallbackApps{
+		DefaultCallbackApp: {Name: DefaultCallbackApp, Dispatcher: DefaultDispatcher},
+		"hr":               {Name: "hr", Dispatcher: hr},
+	}
+
+	if apps.Dispatcher("") != DefaultDispatcher {
+		t.Fatal("empty app name should use the default dispatcher")
+	}
+	if apps.Dispatcher("hr") != hr {
+		t.Fatal("hr dispatcher not found")
+	}
+	if apps.Dispatcher("oa") != nil {
+		t.Fatal("unknown app should have no dispatcher")
+	}
+}
+
+func TestOnAppEventUnknownApp(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("OnAppEvent for an unknown app should panic")
+		}
+	}()
+	OnAppEvent(CallbackApps{}, "oa", "user_add_org", func(ctx context.Context, evt UserAddOrgEvent) error { return nil })
+}
@@ -0,0 +1,254 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fastwego/dingding"
+)
+
+// 推送失败的事件，Payload 已转换为与 Callback 解密后相同的格式
+type failedEvent struct {
+	Id        string          `json:"id"`
+	EventType string          `json:"event_type"`
+	EventTime int64           `json:"event_time"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// 已拉取事件 id 的保留条数，超过后丢弃最早的
+const failedSeenLimit = 10000
+
+// 拉取记录：Seen 为最近已拉取事件的 id，按 id 去重
+// 失败事件不保证按 event_time 顺序出现（翻页、两次拉取之间新失败的推送），不能按时间水位判断
+// Pending 为已拉取但尚未写入事件队列的事件（钉钉拉取后即删除，需本地保留）
+type failedCursor struct {
+	Seen    []string      `json:"seen"`
+	Pending []failedEvent `json:"pending"`
+
+	seenSet map[string]bool
+}
+
+// FailedEvents 拉取默认应用推送失败的事件写入事件队列，拉取记录保存在 CursorFile
+type FailedEvents struct {
+	Client     *dingding.Client
+	Events     *EventQueue
+	CursorFile string
+
+	mu sync.Mutex
+}
+
+func NewFailedEvents(client *dingding.Client, events *EventQueue, cursorFile string) *FailedEvents {
+	return &FailedEvents{Client: client, Events: events, CursorFile: cursorFile}
+}
+
+func (f *FailedEvents) loadCursor() (cursor failedCursor, err error) {
+	data, err := ioutil.ReadFile(f.CursorFile)
+	if os.IsNotExist(err) {
+		return cursor, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &cursor)
+	return
+}
+
+func (f *FailedEvents) saveCursor(cursor failedCursor) (err error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return
+	}
+
+	// 先写临时文件再替换，避免写一半时进程退出
+	tmp := f.CursorFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, f.CursorFile)
+}
+
+// 是否已经拉取过
+func (cursor *failedCursor) seen(evt failedEvent) bool {
+	if cursor.seenSet == nil {
+		cursor.seenSet = make(map[string]bool, len(cursor.Seen))
+		for _, id := range cursor.Seen {
+			cursor.seenSet[id] = true
+		}
+	}
+	return cursor.seenSet[evt.Id]
+}
+
+func (cursor *failedCursor) advance(evt failedEvent) {
+	if cursor.seen(evt) {
+		return
+	}
+	cursor.Seen = append(cursor.Seen, evt.Id)
+	cursor.seenSet[evt.Id] = true
+
+	if over := len(cursor.Seen) - failedSeenLimit; over > 0 {
+		for _, id := range cursor.Seen[:over] {
+			delete(cursor.seenSet, id)
+		}
+		cursor.Seen = append([]string(nil), cursor.Seen[over:]...)
+	}
+}
+
+// 获取推送失败的事件，每次最多返回 200 条
+func (f *FailedEvents) fetch() (events []failedEvent, hasMore bool, err error) {
+	req, _ := http.NewRequest(http.MethodGet, "/call_back/get_call_back_failed_result", nil)
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return
+	}
+
+	result := struct {
+		Errcode    int                          `json:"errcode"`
+		Errmsg     string                       `json:"errmsg"`
+		HasMore    bool                         `json:"has_more"`
+		FailedList []map[string]json.RawMessage `json:"failed_list"`
+	}{}
+	err = json.Unmarshal(resp, &result)
+	if err != nil {
+		return
+	}
+	if result.Errcode != 0 {
+		return nil, false, fmt.Errorf("get_call_back_failed_result: %d %s", result.Errcode, result.Errmsg)
+	}
+
+	for _, item := range result.FailedList {
+		evt, err := convertFailedItem(item)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		events = append(events, evt)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].EventTime < events[j].EventTime
+	})
+
+	return events, result.HasMore, nil
+}
+
+// 失败列表格式：{"event_time":1497360315519,"call_back_tag":"user_add_org","user_add_org":{"corpid":"","userid":[]}}
+// 转换为推送格式：{"EventType":"user_add_org","TimeStamp":1497360315519,"corpid":"","userid":[]}
+// 事件结构体的 json 字段名匹配不区分大小写，可直接解析
+func convertFailedItem(item map[string]json.RawMessage) (evt failedEvent, err error) {
+	err = json.Unmarshal(item["call_back_tag"], &evt.EventType)
+	if err != nil {
+		return evt, fmt.Errorf("failed item call_back_tag: %w", err)
+	}
+	err = json.Unmarshal(item["event_time"], &evt.EventTime)
+	if err != nil {
+		return evt, fmt.Errorf("failed item event_time: %w", err)
+	}
+
+	payload := map[string]interface{}{}
+	if data, ok := item[evt.EventType]; ok {
+		if err = json.Unmarshal(data, &payload); err != nil {
+			return evt, fmt.Errorf("failed item %s: %w", evt.EventType, err)
+		}
+	}
+	payload["EventType"] = evt.EventType
+	payload["TimeStamp"] = evt.EventTime
+
+	evt.Payload, err = json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	raw, _ := json.Marshal(item)
+	sum := sha1.Sum(raw)
+	evt.Id = hex.EncodeToString(sum[:])
+
+	return
+}
+
+// Replay 拉取推送失败的事件写入事件队列，写入失败的事件保留到下次重试
+func (f *FailedEvents) Replay(ctx context.Context) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cursor, err := f.loadCursor()
+	if err != nil {
+		return
+	}
+
+	for {
+		events, hasMore, err := f.fetch()
+		if err != nil {
+			return err
+		}
+
+		for _, evt := range events {
+			if cursor.seen(evt) {
+				continue
+			}
+			cursor.advance(evt)
+			cursor.Pending = append(cursor.Pending, evt)
+		}
+
+		if err = f.saveCursor(cursor); err != nil {
+			return err
+		}
+
+		if !hasMore || len(events) == 0 {
+			break
+		}
+	}
+
+	var pending []failedEvent
+	for _, evt := range cursor.Pending {
+		err := f.Events.Enqueue(DefaultCallbackApp, evt.EventType, evt.Payload)
+		if err != nil {
+			log.Println(err)
+			pending = append(pending, evt)
+		}
+	}
+	cursor.Pending = pending
+
+	return f.saveCursor(cursor)
+}
+
+// Poll 定时拉取推送失败的事件，ctx 取消后停止
+func (f *FailedEvents) Poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := f.Replay(ctx); err != nil {
+			log.Println(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestFailedCursorSeen(t *testing.T) {
+	cursor := failedCursor{}
+
+	// 后拉取到的事件 event_time 更早：不能被当作已拉取
+	newer := failedEvent{Id: "b", EventTime: 200}
+	older := failedEvent{Id: "a", EventTime: 100}
+
+	if cursor.seen(newer) {
+		t.Fatal("new cursor should not have seen anything")
+	}
+	cursor.advance(newer)
+	if !cursor.seen(newer) {
+		t.Fatal("advanced event should be seen")
+	}
+	if cursor.seen(older) {
+		t.Fatal("older event on a later page should not be seen")
+	}
+	cursor.advance(older)
+	cursor.advance(older)
+	if len(cursor.Seen) != 2 {
+		t.Fatalf("seen = %v, want 2 ids", cursor.Seen)
+	}
+}
+
+func TestFailedCursorReload(t *testing.T) {
+	cursor := failedCursor{}
+	cursor.advance(failedEvent{Id: "a"})
+
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := failedCursor{}
+	if err = json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.seen(failedEvent{Id: "a"}) {
+		t.Fatal("reloaded cursor lost seen id")
+	}
+}
+
+func TestFailedCursorLimit(t *testing.T) {
+	cursor := failedCursor{}
+	for i := 0; i < failedSeenLimit+10; i++ {
+		cursor.advance(failedEvent{Id: strconv.Itoa(i)})
+	}
+
+	if len(cursor.Seen) != failedSeenLimit {
+		t.Fatalf("len(seen) = %d, want %d", len(cursor.Seen), failedSeenLimit)
+	}
+	if cursor.seen(failedEvent{Id: "0"}) {
+		t.Fatal("oldest id should be dropped")
+	}
+	if !cursor.seen(failedEvent{Id: strconv.Itoa(failedSeenLimit + 9)}) {
+		t.Fatal("newest id should be kept")
+	}
+}
+
+func TestConvertFailedItem(t *testing.T) {
+	item := map[string]json.RawMessage{}
+	err := json.Unmarshal([]byte(`{"event_time":1497360315519,"call_back_tag":"user_add_org","user_add_org":{"corpid":"ding1","userid":["u1"]}}`), &item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evt, err := convertFailedItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt.EventType != "user_add_org" || evt.EventTime != 1497360315519 || len(evt.Id) == 0 {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+
+	payload := map[string]interface{}{}
+	if err = json.Unmarshal(evt.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["EventType"] != "user_add_org" || payload["corpid"] != "ding1" {
+		t.Fatalf("unexpected payload %s", evt.Payload)
+	}
+
+	// 相同内容的 id 相同，不同内容的 id 不同
+	again, _ := convertFailedItem(item)
+	if again.Id != evt.Id {
+		t.Fatal("id should be stable")
+	}
+	item["event_time"] = json.RawMessage(`1497360315520`)
+	other, _ := convertFailedItem(item)
+	if other.Id == evt.Id {
+		t.Fatal("different items should have different ids")
+	}
+}
+
+func TestConvertFailedItemMissingTag(t *testing.T) {
+	if _, err := convertFailedItem(map[string]json.RawMessage{"event_time": json.RawMessage(`1`)}); err == nil {
+		t.Fatal("expected error for missing call_back_tag")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/fastwego/dingding"
+)
+
+// 回调注册参数
+type callBackPayload struct {
+	CallBackTag []string `json:"call_back_tag"`
+	Token       string   `json:"token"`
+	AesKey      string   `json:"aes_key"`
+	Url         string   `json:"url"`
+}
+
+// CallBackRegistrar 注册、更新与删除事件回调
+type CallBackRegistrar struct {
+	Client *dingding.Client
+	// 注册参数，来自 .env 的 CallbackTags / TOKEN / EncodingAESKey / CallbackUrl
+	Payload callBackPayload
+}
+
+// 按 DingConfig 创建
+func newCallBackRegistrar(client *dingding.Client) *CallBackRegistrar {
+	return &CallBackRegistrar{
+		Client: client,
+		Payload: callBackPayload{
+			CallBackTag: splitComma(DingConfig["CallbackTags"]),
+			Token:       DingConfig["Token"],
+			AesKey:      DingConfig["EncodingAESKey"],
+			Url:         DingConfig["CallbackUrl"],
+		},
+	}
+}
+
+func (cb *CallBackRegistrar) request(uri string) (resp []byte, err error) {
+	payload, err := json.Marshal(cb.Payload)
+	if err != nil {
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, uri, bytes.NewReader(payload))
+	return cb.Client.Do(req)
+}
+
+// Get 查询已注册的事件回调
+func (cb *CallBackRegistrar) Get() (resp []byte, err error) {
+	req, _ := http.NewRequest(http.MethodGet, "/call_back/get_call_back", nil)
+	return cb.Client.Do(req)
+}
+
+// Register 注册事件回调
+func (cb *CallBackRegistrar) Register() (resp []byte, err error) {
+	return cb.request("/call_back/register_call_back")
+}
+
+// Update 更新事件回调
+func (cb *CallBackRegistrar) Update() (resp []byte, err error) {
+	return cb.request("/call_back/update_call_back")
+}
+
+// Delete 删除事件回调
+func (cb *CallBackRegistrar) Delete() (resp []byte, err error) {
+	req, _ := http.NewRequest(http.MethodGet, "/call_back/delete_call_back", nil)
+	return cb.Client.Do(req)
+}
+
+// 回调地址不存在
+const errcodeCallBackNotExist = 71007
+
+func checkCallBackResponse(api string, resp []byte) (errcode int, err error) {
+	result := struct {
+		Errcode int    `json:"errcode"`
+		Errmsg  string `json:"errmsg"`
+	}{}
+	if err = json.Unmarshal(resp, &result); err != nil {
+		return 0, fmt.Errorf("%s: %w", api, err)
+	}
+	if result.Errcode != 0 {
+		return result.Errcode, fmt.Errorf("%s: %d %s", api, result.Errcode, result.Errmsg)
+	}
+	return 0, nil
+}
+
+// 按 get_call_back 的 errcode 判断是否已注册；请求失败或其他 errcode 不做猜测，直接返回错误
+func callBackRegistered(resp []byte, err error) (registered bool, _ error) {
+	if err != nil {
+		return false, err
+	}
+	errcode, err := checkCallBackResponse("get_call_back", resp)
+	if errcode == errcodeCallBackNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Ensure 已注册则更新，否则注册
+func (cb *CallBackRegistrar) Ensure() (err error) {
+	registered, err := callBackRegistered(cb.Get())
+	if err != nil {
+		return
+	}
+
+	api, request := "register_call_back", cb.Register
+	if registered {
+		api, request = "update_call_back", cb.Update
+	}
+	resp, err := request()
+	if err != nil {
+		return
+	}
+	if _, err = checkCallBackResponse(api, resp); err != nil {
+		return
+	}
+
+	log.Println(string(resp))
+	return
+}
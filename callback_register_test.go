@@ -0,0 +1,43 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCallBackRegistered(t *testing.T) {
+	tests := []struct {
+		name       string
+		resp       string
+		err        error
+		registered bool
+		wantErr    bool
+	}{
+		{"registered", `{"errcode":0,"errmsg":"ok","url":"https://example.com/callback"}`, nil, true, false},
+		{"not registered", `{"errcode":71007,"errmsg":"回调地址已不存在"}`, nil, false, false},
+		{"other errcode", `{"errcode":-1,"errmsg":"系统繁忙"}`, nil, false, true},
+		{"request failed", ``, errors.New("timeout"), false, true},
+		{"invalid body", `<html>`, nil, false, true},
+	}
+
+	for _, tt := range tests {
+		registered, err := callBackRegistered([]byte(tt.resp), tt.err)
+		if registered != tt.registered || (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %v, %v; want %v, error %v", tt.name, registered, err, tt.registered, tt.wantErr)
+		}
+	}
+}
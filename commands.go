@@ -0,0 +1,111 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// 子命令：dingding-demo <command> [args...]
+var commands = map[string]func(args []string) error{
+	"callback":       callBackCommand,
+	"replay-failed":  replayFailedCommand,
+	"simulate-event": simulateEventCommand,
+	"sync-directory": syncDirectoryCommand,
+}
+
+func runCommand(args []string) {
+	command, ok := commands[args[0]]
+	if !ok {
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "unknown command %q, available: %v\n", args[0], names)
+		os.Exit(2)
+	}
+
+	if err := command(args[1:]); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// dingding-demo callback list|register|update|delete
+func callBackCommand(args []string) (err error) {
+	if len(args) == 0 {
+		return errors.New("usage: callback list|register|update|delete")
+	}
+
+	client, _, _, err := newDingClient()
+	if err != nil {
+		return
+	}
+	registrar := newCallBackRegistrar(client)
+
+	var resp []byte
+	switch args[0] {
+	case "list":
+		resp, err = registrar.Get()
+	case "register":
+		resp, err = registrar.Register()
+	case "update":
+		resp, err = registrar.Update()
+	case "delete":
+		resp, err = registrar.Delete()
+	default:
+		return fmt.Errorf("unknown callback action %q", args[0])
+	}
+	if err != nil {
+		return
+	}
+
+	fmt.Println(string(resp))
+	return
+}
+
+// dingding-demo replay-failed
+// 只把事件写入 EventQueueDir（以及订阅方的 ForwardQueueDir），不在本进程处理；
+// 由运行中的服务定时扫描队列目录执行处理函数与转发，服务未运行时下次启动后处理
+func replayFailedCommand(args []string) error {
+	client, _, _, err := newDingClient()
+	if err != nil {
+		return err
+	}
+	events, _, err := newEvents(loadCallbackApps(), NewLocalBroker())
+	if err != nil {
+		return err
+	}
+	return NewFailedEvents(client, events, DingConfig["FailedCursorFile"]).Replay(context.Background())
+}
+
+// dingding-demo sync-directory
+func syncDirectoryCommand(args []string) error {
+	client, _, _, err := newDingClient()
+	if err != nil {
+		return err
+	}
+	db, directory, _, err := openStores(client)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return directory.FullSync(context.Background())
+}
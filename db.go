@@ -0,0 +1,50 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ErrNotFound 本地存储中不存在
+var ErrNotFound = errors.New("not found")
+
+// 打开 SQLite 数据库，schema 由各模块自行创建
+func openDB(path string) (db *sql.DB, err error) {
+	db, err = sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return
+	}
+	// SQLite 单写者，避免 database is locked
+	db.SetMaxOpenConns(1)
+	return db, db.Ping()
+}
+
+// 查询结果统一输出
+func queryResponse(c *gin.Context, data interface{}, err error) {
+	switch {
+	case err == ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, data)
+	}
+}
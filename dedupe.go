@@ -0,0 +1,334 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/viper"
+)
+
+// DedupeStore 事件去重存储
+type DedupeStore interface {
+	// Mark 记录 key，ttl 内已记录过时返回 false
+	Mark(key string, ttl time.Duration) (added bool, err error)
+	// Forget 删除 key，事件未能写入队列时回滚
+	Forget(key string) error
+}
+
+// 根据配置创建去重存储：memory（默认）/ file / redis
+func newDedupeStore(kind string) (store DedupeStore, err error) {
+	switch kind {
+	case "", "memory":
+		return NewMemoryDedupeStore(viper.GetInt("DedupeCapacity")), nil
+	case "file":
+		return NewFileDedupeStore(viper.GetString("DedupeDir"))
+	case "redis":
+		return NewRedisDedupeStore(redis.NewClient(&redis.Options{
+			Addr:     viper.GetString("RedisAddr"),
+			Password: viper.GetString("RedisPassword"),
+			DB:       viper.GetInt("RedisDB"),
+		})), nil
+	default:
+		return nil, fmt.Errorf("unknown DedupeStore %q", kind)
+	}
+}
+
+// 事件去重 key：应用 + 事件类型 + 事件时间 + 内容摘要
+// 内容摘要基于规范化后的事件 json（字段名转小写、排序），包含 UserId/DeptId/processInstanceId 等标识，
+// 因此钉钉重复推送与 get_call_back_failed_result 拉取到的同一事件得到相同的 key
+func eventDedupeKey(app string, eventType string, payload []byte) (key string, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var data interface{}
+	if err = decoder.Decode(&data); err != nil {
+		return
+	}
+
+	fields, _ := canonicalJson(data).(map[string]interface{})
+
+	// 推送中的 TimeStamp 可能是字符串，单独取出放入 key，不参与摘要
+	timestamp := ""
+	for _, name := range []string{"timestamp", "finishtime", "createtime"} {
+		if value, ok := fields[name]; ok && value != nil {
+			timestamp = fmt.Sprint(value)
+			break
+		}
+	}
+	delete(fields, "timestamp")
+	delete(fields, "eventtype")
+
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(canonical)
+
+	return "dingding:event:" + app + ":" + eventType + ":" + timestamp + ":" + hex.EncodeToString(sum[:16]), nil
+}
+
+func canonicalJson(data interface{}) interface{} {
+	switch value := data.(type) {
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			fields[strings.ToLower(k)] = canonicalJson(v)
+		}
+		return fields
+	case []interface{}:
+		for i, v := range value {
+			value[i] = canonicalJson(v)
+		}
+		return value
+	case json.Number:
+		return value.String()
+	default:
+		return value
+	}
+}
+
+// MemoryDedupeStore 进程内 LRU，超过容量淘汰最久未访问的 key
+type MemoryDedupeStore struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type memoryDedupeEntry struct {
+	key      string
+	expireAt time.Time
+}
+
+func NewMemoryDedupeStore(capacity int) *MemoryDedupeStore {
+	if capacity <= 0 {
+		capacity = 10000
+	}
+	return &MemoryDedupeStore{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (s *MemoryDedupeStore) Mark(key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if element, ok := s.entries[key]; ok {
+		entry := element.Value.(*memoryDedupeEntry)
+		if now.Before(entry.expireAt) {
+			s.order.MoveToFront(element)
+			return false, nil
+		}
+		s.order.Remove(element)
+		delete(s.entries, key)
+	}
+
+	s.entries[key] = s.order.PushFront(&memoryDedupeEntry{key: key, expireAt: now.Add(ttl)})
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryDedupeEntry).key)
+	}
+
+	return true, nil
+}
+
+func (s *MemoryDedupeStore) Forget(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.entries[key]; ok {
+		s.order.Remove(element)
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+// 清理过期文件的间隔
+const dedupeSweepInterval = 10 * time.Minute
+
+// FileDedupeStore 每个 key 一个文件，内容为过期时间，多个进程共享同一目录时同样生效
+// 过期文件由 Mark 定期触发的后台清理删除，目录大小与 DedupeTTL 内的事件数相当
+type FileDedupeStore struct {
+	dir string
+	mu  sync.Mutex
+
+	lastSweep time.Time
+	sweeping  bool
+}
+
+func NewFileDedupeStore(dir string) (*FileDedupeStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileDedupeStore{dir: dir}, nil
+}
+
+func (s *FileDedupeStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *FileDedupeStore) Mark(key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maybeSweep()
+
+	path := s.path(key)
+	expireAt := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+
+	// 先写临时文件再硬链接为 key：链接是原子的，其他进程不会读到尚未写入的空文件
+	tmp, err := s.writeTemp(expireAt)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+
+	err = os.Link(tmp, path)
+	if err == nil {
+		return true, nil
+	}
+	if !os.IsExist(err) {
+		return false, err
+	}
+
+	// 已存在：未过期即重复，内容无法解析时同样视为重复；过期则覆盖
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	expire, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil || time.Now().Unix() < expire {
+		return false, nil
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// 在同一目录写入临时文件，返回路径
+func (s *FileDedupeStore) writeTemp(content string) (path string, err error) {
+	file, err := ioutil.TempFile(s.dir, ".mark-")
+	if err != nil {
+		return
+	}
+	path = file.Name()
+
+	_, err = file.WriteString(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return
+}
+
+// 调用方持有锁
+func (s *FileDedupeStore) maybeSweep() {
+	if s.sweeping || time.Since(s.lastSweep) < dedupeSweepInterval {
+		return
+	}
+	s.sweeping = true
+	s.lastSweep = time.Now()
+
+	go func() {
+		if _, err := s.Sweep(); err != nil {
+			log.Println(err)
+		}
+		s.mu.Lock()
+		s.sweeping = false
+		s.mu.Unlock()
+	}()
+}
+
+// Sweep 删除已过期的 key，返回删除的数量
+func (s *FileDedupeStore) Sweep() (removed int, err error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		// 逐个加锁，不阻塞 Mark 太久
+		s.mu.Lock()
+		path := filepath.Join(s.dir, f.Name())
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			// 其他进程刚创建、尚未写入过期时间的临时文件解析失败，跳过
+			if expire, parseErr := strconv.ParseInt(string(data), 10, 64); parseErr == nil && expire <= now {
+				if err = os.Remove(path); err == nil {
+					removed++
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func (s *FileDedupeStore) Forget(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// RedisDedupeStore 使用 SET NX EX，兼容 Redis 协议的存储均可
+type RedisDedupeStore struct {
+	client *redis.Client
+}
+
+func NewRedisDedupeStore(client *redis.Client) *RedisDedupeStore {
+	return &RedisDedupeStore{client: client}
+}
+
+func (s *RedisDedupeStore) Mark(key string, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(context.Background(), key, 1, ttl).Result()
+}
+
+func (s *RedisDedupeStore) Forget(key string) error {
+	return s.client.Del(context.Background(), key).Err()
+}
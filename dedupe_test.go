@@ -0,0 +1,233 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventDedupeKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		equal bool
+	}{
+		{
+			"字段名大小写与顺序",
+			`{"EventType":"user_add_org","TimeStamp":"1497360315519","UserId":["u1"],"CorpId":"ding1"}`,
+			`{"corpid":"ding1","userid":["u1"],"TimeStamp":1497360315519,"EventType":"user_add_org"}`,
+			true,
+		},
+		{
+			"不同员工",
+			`{"EventType":"user_add_org","TimeStamp":1497360315519,"UserId":["u1"]}`,
+			`{"EventType":"user_add_org","TimeStamp":1497360315519,"UserId":["u2"]}`,
+			false,
+		},
+		{
+			"不同时间",
+			`{"EventType":"user_add_org","TimeStamp":1497360315519,"UserId":["u1"]}`,
+			`{"EventType":"user_add_org","TimeStamp":1497360315520,"UserId":["u1"]}`,
+			false,
+		},
+		{
+			"审批事件使用 finishTime",
+			`{"EventType":"bpms_instance_change","processInstanceId":"p1","type":"finish","finishTime":1}`,
+			`{"EventType":"bpms_instance_change","processInstanceId":"p1","type":"finish","finishTime":2}`,
+			false,
+		},
+		{
+			"嵌套对象",
+			`{"TimeStamp":1,"Data":{"A":1,"B":[{"X":"y"}]}}`,
+			`{"timestamp":1,"data":{"b":[{"x":"y"}],"a":1}}`,
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		a, err := eventDedupeKey("app", "evt", []byte(tt.a))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		b, err := eventDedupeKey("app", "evt", []byte(tt.b))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if (a == b) != tt.equal {
+			t.Errorf("%s: keys %s / %s, want equal %v", tt.name, a, b, tt.equal)
+		}
+	}
+
+	if _, err := eventDedupeKey("app", "evt", []byte(`not json`)); err == nil {
+		t.Error("expected error for invalid payload")
+	}
+}
+
+func TestMemoryDedupeStore(t *testing.T) {
+	store := NewMemoryDedupeStore(2)
+
+	if added, _ := store.Mark("a", time.Hour); !added {
+		t.Fatal("first mark should be added")
+	}
+	if added, _ := store.Mark("a", time.Hour); added {
+		t.Fatal("second mark should be a duplicate")
+	}
+	if added, _ := store.Mark("expired", -time.Second); !added {
+		t.Fatal("mark should be added")
+	}
+	if added, _ := store.Mark("expired", time.Hour); !added {
+		t.Fatal("expired key should be added again")
+	}
+
+	// 超过容量淘汰最久未访问的
+	store.Mark("b", time.Hour)
+	if added, _ := store.Mark("a", time.Hour); !added {
+		t.Fatal("evicted key should be added again")
+	}
+
+	_ = store.Forget("b")
+	if added, _ := store.Mark("b", time.Hour); !added {
+		t.Fatal("forgotten key should be added again")
+	}
+}
+
+func TestFileDedupeStoreSweep(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileDedupeStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不触发后台清理，结果由下面的 Sweep 决定
+	store.lastSweep = time.Now()
+
+	if added, err := store.Mark("live", time.Hour); err != nil || !added {
+		t.Fatalf("mark live: %v %v", added, err)
+	}
+	if added, err := store.Mark("live", time.Hour); err != nil || added {
+		t.Fatalf("duplicate live: %v %v", added, err)
+	}
+	if _, err = store.Mark("expired", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// 其他进程刚创建的空文件不删除
+	if err = ioutil.WriteFile(filepath.Join(dir, "creating"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("removed = %d, want 1", removed)
+	}
+	if _, err = os.Stat(store.path("live")); err != nil {
+		t.Fatal("live key removed")
+	}
+	if _, err = os.Stat(store.path("expired")); !os.IsNotExist(err) {
+		t.Fatal("expired key kept")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "creating")); err != nil {
+		t.Fatal("empty file removed")
+	}
+}
+
+func TestFileDedupeStoreMarkTriggersSweep(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileDedupeStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	if err = ioutil.WriteFile(store.path("old"), []byte(expired), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Mark("new", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err = os.Stat(store.path("old")); os.IsNotExist(err) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired key not swept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 其他进程创建的空文件或无法解析的文件视为已处理，不能再次放行
+func TestFileDedupeStoreUnreadableIsSeen(t *testing.T) {
+	store, err := NewFileDedupeStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, content := range []string{"", "garbage"} {
+		if err = ioutil.WriteFile(store.path("k"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if added, err := store.Mark("k", time.Hour); err != nil || added {
+			t.Fatalf("content %q: added = %v, %v", content, added, err)
+		}
+	}
+}
+
+// 多个进程共享目录并发标记同一个 key，只有一个放行
+func TestFileDedupeStoreConcurrentProcesses(t *testing.T) {
+	dir := t.TempDir()
+
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < 8; i++ {
+		store, err := NewFileDedupeStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := store.Mark("k", time.Hour)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				atomic.AddInt32(&added, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if added != 1 {
+		t.Fatalf("added = %d, want 1", added)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("temp files left: %d files", len(files))
+	}
+}
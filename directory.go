@@ -0,0 +1,469 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fastwego/dingding"
+	"github.com/gin-gonic/gin"
+)
+
+// DirectoryUser 员工，字段与 /user/get 一致
+type DirectoryUser struct {
+	Userid     string  `json:"userid"`
+	Unionid    string  `json:"unionid"`
+	Name       string  `json:"name"`
+	Mobile     string  `json:"mobile"`
+	Email      string  `json:"email"`
+	OrgEmail   string  `json:"orgEmail"`
+	Avatar     string  `json:"avatar"`
+	Position   string  `json:"position"`
+	Jobnumber  string  `json:"jobnumber"`
+	Department []int64 `json:"department"`
+	Active     bool    `json:"active"`
+	IsAdmin    bool    `json:"isAdmin"`
+	IsBoss     bool    `json:"isBoss"`
+}
+
+// DirectoryDepartment 部门，字段与 /department/get 一致
+type DirectoryDepartment struct {
+	Id       int64  `json:"id"`
+	Name     string `json:"name"`
+	Parentid int64  `json:"parentid"`
+	Order    int64  `json:"order"`
+}
+
+const directorySchema = `
+CREATE TABLE IF NOT EXISTS directory_departments (
+	id        INTEGER PRIMARY KEY,
+	parent_id INTEGER NOT NULL,
+	raw       TEXT    NOT NULL,
+	synced_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS directory_users (
+	userid    TEXT PRIMARY KEY,
+	mobile    TEXT    NOT NULL,
+	raw       TEXT    NOT NULL,
+	synced_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS directory_users_mobile ON directory_users (mobile);
+CREATE TABLE IF NOT EXISTS directory_user_departments (
+	userid  TEXT    NOT NULL,
+	dept_id INTEGER NOT NULL,
+	PRIMARY KEY (userid, dept_id)
+);
+CREATE INDEX IF NOT EXISTS directory_user_departments_dept ON directory_user_departments (dept_id);
+`
+
+// 根部门 id
+const rootDepartmentId = 1
+
+// Directory 通讯录本地镜像：全量拉取部门与员工，再由通讯录事件增量更新
+type Directory struct {
+	db     *sql.DB
+	client *dingding.Client
+
+	// 全量同步互斥
+	syncing sync.Mutex
+}
+
+func NewDirectory(db *sql.DB, client *dingding.Client) (directory *Directory, err error) {
+	if _, err = db.Exec(directorySchema); err != nil {
+		return
+	}
+	return &Directory{db: db, client: client}, nil
+}
+
+// 错误响应同样能解析为空列表，须先检查 errcode，否则全量同步会把本地镜像当作已删除
+func (d *Directory) get(uri string, params url.Values, v interface{}) (err error) {
+	req, _ := http.NewRequest(http.MethodGet, uri+"?"+params.Encode(), nil)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return
+	}
+
+	result := struct {
+		Errcode int    `json:"errcode"`
+		Errmsg  string `json:"errmsg"`
+	}{}
+	if err = json.Unmarshal(resp, &result); err != nil {
+		return
+	}
+	if result.Errcode != 0 {
+		return fmt.Errorf("%s: %d %s", uri, result.Errcode, result.Errmsg)
+	}
+	return json.Unmarshal(resp, v)
+}
+
+func (d *Directory) saveDepartment(raw json.RawMessage, syncedAt int64) (err error) {
+	dept := DirectoryDepartment{}
+	if err = json.Unmarshal(raw, &dept); err != nil {
+		return
+	}
+	if dept.Id == 0 {
+		return fmt.Errorf("department without id: %s", raw)
+	}
+	_, err = d.db.Exec(`INSERT INTO directory_departments (id, parent_id, raw, synced_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET parent_id = excluded.parent_id, raw = excluded.raw, synced_at = excluded.synced_at`,
+		dept.Id, dept.Parentid, string(raw), syncedAt)
+	return
+}
+
+func (d *Directory) saveUser(raw json.RawMessage, syncedAt int64) (err error) {
+	user := DirectoryUser{}
+	if err = json.Unmarshal(raw, &user); err != nil {
+		return
+	}
+	if len(user.Userid) == 0 {
+		return fmt.Errorf("user without userid: %s", raw)
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO directory_users (userid, mobile, raw, synced_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (userid) DO UPDATE SET mobile = excluded.mobile, raw = excluded.raw, synced_at = excluded.synced_at`,
+		user.Userid, user.Mobile, string(raw), syncedAt)
+	if err != nil {
+		return
+	}
+	if _, err = tx.Exec(`DELETE FROM directory_user_departments WHERE userid = ?`, user.Userid); err != nil {
+		return
+	}
+	for _, deptId := range user.Department {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO directory_user_departments (userid, dept_id) VALUES (?, ?)`, user.Userid, deptId)
+		if err != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+// FullSync 全量拉取部门与员工，结束后删除本次未拉取到的记录
+// 任一请求失败即返回，不执行删除，避免误删本地镜像
+func (d *Directory) FullSync(ctx context.Context) (err error) {
+	d.syncing.Lock()
+	defer d.syncing.Unlock()
+
+	syncedAt := time.Now().UnixNano()
+
+	// 根部门
+	root := json.RawMessage{}
+	params := url.Values{}
+	params.Add("id", strconv.Itoa(rootDepartmentId))
+	if err = d.get("/department/get", params, &root); err != nil {
+		return
+	}
+	if err = d.saveDepartment(root, syncedAt); err != nil {
+		return
+	}
+
+	// 全部子部门
+	deptList := struct {
+		Department []json.RawMessage `json:"department"`
+	}{}
+	params = url.Values{}
+	params.Add("id", strconv.Itoa(rootDepartmentId))
+	params.Add("fetch_child", "true")
+	if err = d.get("/department/list", params, &deptList); err != nil {
+		return
+	}
+
+	deptIds := []int64{rootDepartmentId}
+	for _, raw := range deptList.Department {
+		if err = d.saveDepartment(raw, syncedAt); err != nil {
+			return
+		}
+		dept := DirectoryDepartment{}
+		_ = json.Unmarshal(raw, &dept)
+		deptIds = append(deptIds, dept.Id)
+	}
+
+	// 各部门员工
+	for _, deptId := range deptIds {
+		for offset := 0; ; offset += 100 {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+
+			page := struct {
+				HasMore  bool              `json:"hasMore"`
+				Userlist []json.RawMessage `json:"userlist"`
+			}{}
+			params = url.Values{}
+			params.Add("department_id", strconv.FormatInt(deptId, 10))
+			params.Add("offset", strconv.Itoa(offset))
+			params.Add("size", "100")
+			if err = d.get("/user/listbypage", params, &page); err != nil {
+				return
+			}
+			for _, raw := range page.Userlist {
+				if err = d.saveUser(raw, syncedAt); err != nil {
+					return
+				}
+			}
+			if !page.HasMore {
+				break
+			}
+		}
+	}
+
+	// 本次未出现的部门/员工已被删除
+	if _, err = d.db.Exec(`DELETE FROM directory_departments WHERE synced_at < ?`, syncedAt); err != nil {
+		return
+	}
+	if _, err = d.db.Exec(`DELETE FROM directory_user_departments WHERE userid IN (SELECT userid FROM directory_users WHERE synced_at < ?)`, syncedAt); err != nil {
+		return
+	}
+	_, err = d.db.Exec(`DELETE FROM directory_users WHERE synced_at < ?`, syncedAt)
+	return
+}
+
+// SyncUser 从 /user/get 更新单个员工
+func (d *Directory) SyncUser(userid string) (err error) {
+	if len(userid) == 0 {
+		return errors.New("empty userid")
+	}
+
+	raw := json.RawMessage{}
+	params := url.Values{}
+	params.Add("userid", userid)
+	if err = d.get("/user/get", params, &raw); err != nil {
+		return
+	}
+	return d.saveUser(raw, time.Now().UnixNano())
+}
+
+// RemoveUser 删除员工
+func (d *Directory) RemoveUser(userid string) (err error) {
+	if _, err = d.db.Exec(`DELETE FROM directory_user_departments WHERE userid = ?`, userid); err != nil {
+		return
+	}
+	_, err = d.db.Exec(`DELETE FROM directory_users WHERE userid = ?`, userid)
+	return
+}
+
+// SyncDepartment 从 /department/get 更新单个部门
+func (d *Directory) SyncDepartment(id int64) (err error) {
+	raw := json.RawMessage{}
+	params := url.Values{}
+	params.Add("id", strconv.FormatInt(id, 10))
+	if err = d.get("/department/get", params, &raw); err != nil {
+		return
+	}
+	return d.saveDepartment(raw, time.Now().UnixNano())
+}
+
+// RemoveDepartment 删除部门
+func (d *Directory) RemoveDepartment(id int64) (err error) {
+	if _, err = d.db.Exec(`DELETE FROM directory_user_departments WHERE dept_id = ?`, id); err != nil {
+		return
+	}
+	_, err = d.db.Exec(`DELETE FROM directory_departments WHERE id = ?`, id)
+	return
+}
+
+// RegisterHandlers 注册通讯录事件的增量更新
+func (d *Directory) RegisterHandlers(dispatcher *EventDispatcher) {
+	syncUsers := func(ctx context.Context, evt UserEvent) error {
+		for _, userid := range evt.UserId {
+			if err := d.SyncUser(userid); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	On(dispatcher, "user_add_org", syncUsers)
+	On(dispatcher, "user_modify_org", syncUsers)
+	On(dispatcher, "user_active_org", syncUsers)
+	On(dispatcher, "user_leave_org", func(ctx context.Context, evt UserLeaveOrgEvent) error {
+		for _, userid := range evt.UserId {
+			if err := d.RemoveUser(userid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	syncDepartments := func(ctx context.Context, evt DeptEvent) error {
+		for _, id := range evt.DeptId {
+			if err := d.SyncDepartment(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	On(dispatcher, "org_dept_create", syncDepartments)
+	On(dispatcher, "org_dept_modify", syncDepartments)
+	On(dispatcher, "org_dept_remove", func(ctx context.Context, evt OrgDeptRemoveEvent) error {
+		for _, id := range evt.DeptId {
+			if err := d.RemoveDepartment(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// IsEmpty 是否从未同步过
+func (d *Directory) IsEmpty() bool {
+	var count int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM directory_departments`).Scan(&count); err != nil {
+		log.Println(err)
+		return true
+	}
+	return count == 0
+}
+
+func (d *Directory) queryUsers(query string, args ...interface{}) (users []DirectoryUser, err error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	users = []DirectoryUser{}
+	for rows.Next() {
+		var raw string
+		if err = rows.Scan(&raw); err != nil {
+			return
+		}
+		user := DirectoryUser{}
+		if err = json.Unmarshal([]byte(raw), &user); err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (d *Directory) queryUser(query string, args ...interface{}) (user DirectoryUser, err error) {
+	users, err := d.queryUsers(query, args...)
+	if err != nil {
+		return
+	}
+	if len(users) == 0 {
+		return user, ErrNotFound
+	}
+	return users[0], nil
+}
+
+// User 按 userid 查询员工
+func (d *Directory) User(userid string) (DirectoryUser, error) {
+	return d.queryUser(`SELECT raw FROM directory_users WHERE userid = ?`, userid)
+}
+
+// UserByMobile 按手机号查询员工
+func (d *Directory) UserByMobile(mobile string) (DirectoryUser, error) {
+	return d.queryUser(`SELECT raw FROM directory_users WHERE mobile = ?`, mobile)
+}
+
+// DepartmentUsers 部门员工（不含子部门）
+func (d *Directory) DepartmentUsers(id int64) ([]DirectoryUser, error) {
+	return d.queryUsers(`SELECT u.raw FROM directory_users u JOIN directory_user_departments ud ON ud.userid = u.userid
+		WHERE ud.dept_id = ? ORDER BY u.userid`, id)
+}
+
+// Departments 全部部门
+func (d *Directory) Departments() (departments []DirectoryDepartment, err error) {
+	rows, err := d.db.Query(`SELECT raw FROM directory_departments ORDER BY id`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	departments = []DirectoryDepartment{}
+	for rows.Next() {
+		var raw string
+		if err = rows.Scan(&raw); err != nil {
+			return
+		}
+		dept := DirectoryDepartment{}
+		if err = json.Unmarshal([]byte(raw), &dept); err != nil {
+			return
+		}
+		departments = append(departments, dept)
+	}
+	return departments, rows.Err()
+}
+
+// Department 按 id 查询部门
+func (d *Directory) Department(id int64) (dept DirectoryDepartment, err error) {
+	var raw string
+	err = d.db.QueryRow(`SELECT raw FROM directory_departments WHERE id = ?`, id).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return dept, ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(raw), &dept)
+	return
+}
+
+// RegisterRoutes 通讯录查询接口
+func (d *Directory) RegisterRoutes(router gin.IRoutes) {
+	router.GET("/api/directory/users", func(c *gin.Context) {
+		// 未公开手机号的员工 mobile 为空，空参数会查到任意一人
+		mobile := c.Query("mobile")
+		if len(mobile) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mobile required"})
+			return
+		}
+		user, err := d.UserByMobile(mobile)
+		queryResponse(c, user, err)
+	})
+	router.GET("/api/directory/users/:userid", func(c *gin.Context) {
+		user, err := d.User(c.Param("userid"))
+		queryResponse(c, user, err)
+	})
+	router.GET("/api/directory/departments", func(c *gin.Context) {
+		departments, err := d.Departments()
+		queryResponse(c, departments, err)
+	})
+	router.GET("/api/directory/departments/:id", func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid department id"})
+			return
+		}
+		dept, err := d.Department(id)
+		queryResponse(c, dept, err)
+	})
+	router.GET("/api/directory/departments/:id/users", func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid department id"})
+			return
+		}
+		users, err := d.DepartmentUsers(id)
+		queryResponse(c, users, err)
+	})
+}
@@ -0,0 +1,316 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fastwego/dingding"
+	"github.com/gin-gonic/gin"
+)
+
+type testAccessToken string
+
+func (t testAccessToken) GetAccessToken() (string, error) { return string(t), nil }
+func (t testAccessToken) GetName() string                 { return "access_token" }
+
+type transportFunc func(*http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// fakeDirectory 模拟钉钉通讯录接口，errcodes 中的接口返回错误
+type fakeDirectory struct {
+	mu          sync.Mutex
+	departments map[int64]string   // id -> /department/get
+	users       map[string]string  // userid -> /user/get
+	members     map[int64][]string // 部门 -> 员工
+	errcodes    map[string]bool
+}
+
+func newFakeDirectory() *fakeDirectory {
+	f := &fakeDirectory{
+		departments: map[int64]string{
+			1: `{"id":1,"name":"总部","parentid":0}`,
+			2: `{"id":2,"name":"研发部","parentid":1}`,
+		},
+		users: map[string]string{
+			"u1": `{"userid":"u1","name":"张三","mobile":"13800000001","department":[1]}`,
+			"u2": `{"userid":"u2","name":"李四","mobile":"13800000002","department":[1]}`,
+			"u3": `{"userid":"u3","name":"王五","mobile":"","department":[2]}`,
+		},
+		members:  map[int64][]string{1: {"u1"}, 2: {"u3"}},
+		errcodes: map[string]bool{},
+	}
+
+	// 总部超过一页（100 人），u2 在第二页
+	for i := 0; i < 100; i++ {
+		userid := fmt.Sprintf("staff%03d", i)
+		f.users[userid] = fmt.Sprintf(`{"userid":"%s","department":[1]}`, userid)
+		f.members[1] = append(f.members[1], userid)
+	}
+	f.members[1] = append(f.members[1], "u2")
+	return f
+}
+
+func (f *fakeDirectory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	if f.errcodes[r.URL.Path] {
+		_, _ = w.Write([]byte(`{"errcode":60011,"errmsg":"no permission"}`))
+		return
+	}
+
+	id, _ := strconv.ParseInt(query.Get("id"), 10, 64)
+	switch r.URL.Path {
+	case "/department/get":
+		if raw, ok := f.departments[id]; ok {
+			_, _ = w.Write([]byte(`{"errcode":0,` + raw[1:]))
+			return
+		}
+		_, _ = w.Write([]byte(`{"errcode":60003,"errmsg":"department not found"}`))
+	case "/department/list":
+		list := []json.RawMessage{}
+		for deptId, raw := range f.departments {
+			if deptId != rootDepartmentId {
+				list = append(list, json.RawMessage(raw))
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 0, "department": list})
+	case "/user/listbypage":
+		deptId, _ := strconv.ParseInt(query.Get("department_id"), 10, 64)
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		size, _ := strconv.Atoi(query.Get("size"))
+		members := f.members[deptId]
+		page := []json.RawMessage{}
+		for i := offset; i < offset+size && i < len(members); i++ {
+			page = append(page, json.RawMessage(f.users[members[i]]))
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 0, "hasMore": offset+size < len(members), "userlist": page})
+	case "/user/get":
+		if raw, ok := f.users[query.Get("userid")]; ok {
+			_, _ = w.Write([]byte(`{"errcode":0,` + raw[1:]))
+			return
+		}
+		_, _ = w.Write([]byte(`{"errcode":60121,"errmsg":"user not found"}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestDirectory 内存 SQLite 与模拟的钉钉接口
+func newTestDirectory(t *testing.T) (*Directory, *fakeDirectory) {
+	db, err := openDB(":memory:")
+	if err != nil {
+		t.Skipf("sqlite unavailable: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	fake := newFakeDirectory()
+	client := dingding.NewClient(testAccessToken("access-token"))
+	client.HTTPClient = &http.Client{Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+		w := httptest.NewRecorder()
+		fake.ServeHTTP(w, r)
+		return w.Result(), nil
+	})}
+
+	directory, err := NewDirectory(db, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return directory, fake
+}
+
+func countRows(t *testing.T, d *Directory, query string, args ...interface{}) (count int) {
+	if err := d.db.QueryRow(query, args...).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestDirectoryFullSyncDeletesStale(t *testing.T) {
+	directory, _ := newTestDirectory(t)
+
+	// 上次同步后已离职的员工与已删除的部门
+	if err := directory.saveDepartment(json.RawMessage(`{"id":3,"name":"已撤销","parentid":1}`), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := directory.saveUser(json.RawMessage(`{"userid":"gone","mobile":"13800000009","department":[3]}`), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := directory.FullSync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := directory.User("gone"); err != ErrNotFound {
+		t.Fatalf("stale user: %v", err)
+	}
+	if _, err := directory.Department(3); err != ErrNotFound {
+		t.Fatalf("stale department: %v", err)
+	}
+	if n := countRows(t, directory, `SELECT COUNT(*) FROM directory_user_departments WHERE userid = 'gone'`); n != 0 {
+		t.Fatalf("stale user departments: %d", n)
+	}
+
+	// 分页拉取的员工都已保存
+	for _, userid := range []string{"u1", "staff099", "u2", "u3"} {
+		if _, err := directory.User(userid); err != nil {
+			t.Fatalf("user %s: %v", userid, err)
+		}
+	}
+	departments, err := directory.Departments()
+	if err != nil || len(departments) != 2 {
+		t.Fatalf("departments = %v, %v", departments, err)
+	}
+	users, err := directory.DepartmentUsers(2)
+	if err != nil || len(users) != 1 || users[0].Userid != "u3" {
+		t.Fatalf("department users = %v, %v", users, err)
+	}
+}
+
+func TestDirectoryFullSyncAbortsOnErrcode(t *testing.T) {
+	for _, path := range []string{"/department/get", "/department/list", "/user/listbypage"} {
+		directory, fake := newTestDirectory(t)
+		if err := directory.saveUser(json.RawMessage(`{"userid":"kept","mobile":"13800000008","department":[1]}`), 1); err != nil {
+			t.Fatal(err)
+		}
+
+		// 错误响应解析出的空列表不能被当作全部已删除
+		fake.errcodes[path] = true
+		if err := directory.FullSync(context.Background()); err == nil {
+			t.Fatalf("%s: FullSync succeeded on errcode", path)
+		}
+		if _, err := directory.User("kept"); err != nil {
+			t.Fatalf("%s: local user deleted: %v", path, err)
+		}
+	}
+}
+
+func TestDirectoryEventHandlers(t *testing.T) {
+	directory, fake := newTestDirectory(t)
+	dispatcher := NewEventDispatcher()
+	directory.RegisterHandlers(dispatcher)
+	ctx := context.Background()
+
+	dispatch := func(eventType string, payload string) error {
+		return dispatcher.Dispatch(ctx, eventType, []byte(payload))
+	}
+
+	// 入职
+	if err := dispatch("user_add_org", `{"EventType":"user_add_org","UserId":["u1","u2"]}`); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := directory.UserByMobile("13800000001"); err != nil || user.Userid != "u1" {
+		t.Fatalf("user = %v, %v", user, err)
+	}
+
+	// 信息变更
+	fake.mu.Lock()
+	fake.users["u1"] = `{"userid":"u1","name":"张三","mobile":"13900000001","department":[2]}`
+	fake.mu.Unlock()
+	if err := dispatch("user_modify_org", `{"EventType":"user_modify_org","UserId":["u1"]}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := directory.UserByMobile("13800000001"); err != ErrNotFound {
+		t.Fatalf("old mobile: %v", err)
+	}
+	if users, err := directory.DepartmentUsers(2); err != nil || len(users) != 1 || users[0].Mobile != "13900000001" {
+		t.Fatalf("department users = %v, %v", users, err)
+	}
+
+	// 离职
+	if err := dispatch("user_leave_org", `{"EventType":"user_leave_org","UserId":["u1"]}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := directory.User("u1"); err != ErrNotFound {
+		t.Fatalf("left user: %v", err)
+	}
+	if n := countRows(t, directory, `SELECT COUNT(*) FROM directory_user_departments WHERE userid = 'u1'`); n != 0 {
+		t.Fatalf("left user departments: %d", n)
+	}
+
+	// 部门新建、删除
+	if err := dispatch("org_dept_create", `{"EventType":"org_dept_create","DeptId":[2]}`); err != nil {
+		t.Fatal(err)
+	}
+	if dept, err := directory.Department(2); err != nil || dept.Name != "研发部" {
+		t.Fatalf("department = %v, %v", dept, err)
+	}
+	if err := dispatch("user_add_org", `{"EventType":"user_add_org","UserId":["u3"]}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := dispatch("org_dept_remove", `{"EventType":"org_dept_remove","DeptId":[2]}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := directory.Department(2); err != ErrNotFound {
+		t.Fatalf("removed department: %v", err)
+	}
+	if users, err := directory.DepartmentUsers(2); err != nil || len(users) != 0 {
+		t.Fatalf("removed department users = %v, %v", users, err)
+	}
+
+	// 拉取失败时返回错误，事件由队列重试
+	if err := dispatch("user_add_org", `{"EventType":"user_add_org","UserId":["unknown"]}`); err == nil {
+		t.Fatal("dispatch succeeded for unknown user")
+	}
+}
+
+func TestDirectoryRoutes(t *testing.T) {
+	directory, _ := newTestDirectory(t)
+	if err := directory.FullSync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	directory.RegisterRoutes(router)
+
+	tests := []struct {
+		target string
+		status int
+		want   string
+	}{
+		// u3 未公开手机号，空参数不能查到 u3
+		{"/api/directory/users", http.StatusBadRequest, ""},
+		{"/api/directory/users?mobile=", http.StatusBadRequest, ""},
+		{"/api/directory/users?mobile=13800000002", http.StatusOK, `"userid":"u2"`},
+		{"/api/directory/users?mobile=13800000000", http.StatusNotFound, ""},
+		{"/api/directory/users/u1", http.StatusOK, `"name":"张三"`},
+		{"/api/directory/users/unknown", http.StatusNotFound, ""},
+		{"/api/directory/departments", http.StatusOK, `"name":"研发部"`},
+		{"/api/directory/departments/2", http.StatusOK, `"parentid":1`},
+		{"/api/directory/departments/99", http.StatusNotFound, ""},
+		{"/api/directory/departments/abc", http.StatusBadRequest, ""},
+		{"/api/directory/departments/2/users", http.StatusOK, `"userid":"u3"`},
+		{"/api/directory/departments/abc/users", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != tt.status || !json.Valid(w.Body.Bytes()) || (len(tt.want) > 0 && !strings.Contains(w.Body.String(), tt.want)) {
+			t.Errorf("%s = %d %s; want %d %s", tt.target, w.Code, w.Body.String(), tt.status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 队列中的事件，每个事件一个 json 文件：<dir>/pending/<id>.json，超过重试次数移到 <dir>/dead/<id>.json
+type QueuedEvent struct {
+	Id          string          `json:"id"`
+	App         string          `json:"app"`
+	EventType   string          `json:"event_type"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	NextAttempt time.Time       `json:"next_attempt"`
+}
+
+const (
+	queuePending = "pending"
+	queueDead    = "dead"
+
+	queueMaxBackoff = 10 * time.Minute
+)
+
+var queueIdPattern = regexp.MustCompile(`^[0-9]+-[0-9]+$`)
+
+// EventQueue 基于本地文件的持久化事件队列
+// Callback 写入后立即响应，由 worker 异步执行事件处理函数，失败按指数退避重试
+type EventQueue struct {
+	Dir         string
+	Dispatcher  func(app string) *EventDispatcher
+	Workers     int
+	MaxAttempts int
+	Backoff     time.Duration
+
+	// 去重：同一事件在 DedupeTTL 内只入队一次
+	Dedupe    DedupeStore
+	DedupeTTL time.Duration
+
+	// 新事件写入后回调，如转发给订阅方
+	OnEnqueued func(evt QueuedEvent)
+
+	// 处理函数，为空时按 Dispatcher 分发给应用的事件处理函数
+	Handler func(ctx context.Context, evt QueuedEvent) error
+
+	seq      uint64
+	mu       sync.Mutex
+	inflight map[string]bool
+	notify   chan struct{}
+}
+
+func NewEventQueue(dir string, dispatcher func(app string) *EventDispatcher) (queue *EventQueue, err error) {
+	for _, sub := range []string{queuePending, queueDead} {
+		if err = os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return
+		}
+	}
+
+	return &EventQueue{
+		Dir:         dir,
+		Dispatcher:  dispatcher,
+		Workers:     4,
+		MaxAttempts: 8,
+		Backoff:     time.Second,
+		Dedupe:      NewMemoryDedupeStore(0),
+		DedupeTTL:   24 * time.Hour,
+		inflight:    map[string]bool{},
+		notify:      make(chan struct{}, 1),
+	}, nil
+}
+
+func (q *EventQueue) path(state string, id string) string {
+	return filepath.Join(q.Dir, state, id+".json")
+}
+
+// 写临时文件 + fsync + rename，保证进程崩溃时不会留下半个文件
+func (q *EventQueue) write(state string, evt QueuedEvent) (err error) {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(q.Dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), q.path(state, evt.Id))
+}
+
+func (q *EventQueue) read(state string, id string) (evt QueuedEvent, err error) {
+	data, err := ioutil.ReadFile(q.path(state, id))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &evt)
+	return
+}
+
+func (q *EventQueue) list(state string) (ids []string, err error) {
+	files, err := ioutil.ReadDir(filepath.Join(q.Dir, state))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	// id 以纳秒时间戳开头，按名称排序即按写入顺序
+	sort.Strings(ids)
+	return
+}
+
+// Enqueue 持久化事件，返回 nil 后即可响应钉钉；重复的事件直接忽略
+func (q *EventQueue) Enqueue(app string, eventType string, payload []byte) (err error) {
+	key, err := eventDedupeKey(app, eventType, payload)
+	if err != nil {
+		return
+	}
+	added, err := q.Dedupe.Mark(key, q.DedupeTTL)
+	if err != nil {
+		return
+	}
+	if !added {
+		log.Printf("event %s duplicated, key %s", eventType, key)
+		return nil
+	}
+
+	err = q.enqueue(app, eventType, payload)
+	if err != nil {
+		// 未写入队列，允许钉钉重试时再次入队
+		_ = q.Dedupe.Forget(key)
+	}
+	return
+}
+
+func (q *EventQueue) enqueue(app string, eventType string, payload []byte) (err error) {
+	now := time.Now()
+	evt := QueuedEvent{
+		Id:          fmt.Sprintf("%d-%d", now.UnixNano(), atomic.AddUint64(&q.seq, 1)),
+		App:         app,
+		EventType:   eventType,
+		Payload:     payload,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+	return q.push(evt)
+}
+
+// 写入 pending 并唤醒调度
+func (q *EventQueue) push(evt QueuedEvent) (err error) {
+	if err = q.write(queuePending, evt); err != nil {
+		return
+	}
+
+	if q.OnEnqueued != nil {
+		q.OnEnqueued(evt)
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// Start 启动调度与 worker，ctx 取消后停止；未处理完的事件留在 pending 下次启动继续
+func (q *EventQueue) Start(ctx context.Context) {
+	jobs := make(chan QueuedEvent)
+
+	for i := 0; i < q.Workers; i++ {
+		go func() {
+			for evt := range jobs {
+				q.process(ctx, evt)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			q.schedule(ctx, jobs)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-q.notify:
+			}
+		}
+	}()
+}
+
+// 把到期的事件交给 worker
+func (q *EventQueue) schedule(ctx context.Context, jobs chan<- QueuedEvent) {
+	ids, err := q.list(queuePending)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		q.mu.Lock()
+		busy := q.inflight[id]
+		q.mu.Unlock()
+		if busy {
+			continue
+		}
+
+		evt, err := q.read(queuePending, id)
+		if err != nil {
+			// 可能刚被 Requeue/处理完删除
+			if !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			continue
+		}
+		if evt.NextAttempt.After(now) {
+			continue
+		}
+
+		q.mu.Lock()
+		q.inflight[id] = true
+		q.mu.Unlock()
+
+		select {
+		case jobs <- evt:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *EventQueue) handle(ctx context.Context, evt QueuedEvent) error {
+	if q.Handler != nil {
+		return q.Handler(ctx, evt)
+	}
+	if dispatcher := q.Dispatcher(evt.App); dispatcher != nil {
+		return dispatcher.Dispatch(ctx, evt.EventType, evt.Payload)
+	}
+	return fmt.Errorf("callback app %q not configured", evt.App)
+}
+
+func (q *EventQueue) process(ctx context.Context, evt QueuedEvent) {
+	defer func() {
+		q.mu.Lock()
+		delete(q.inflight, evt.Id)
+		q.mu.Unlock()
+	}()
+
+	err := q.handle(ctx, evt)
+	if err == nil {
+		if err = os.Remove(q.path(queuePending, evt.Id)); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	evt.Attempts++
+	evt.LastError = err.Error()
+	log.Printf("event %s %s/%s attempt %d failed: %s", evt.Id, evt.App, evt.EventType, evt.Attempts, evt.LastError)
+
+	if evt.Attempts >= q.MaxAttempts {
+		// 进入死信，等待人工处理后 Requeue
+		if err = q.write(queueDead, evt); err != nil {
+			log.Println(err)
+			return
+		}
+		if err = os.Remove(q.path(queuePending, evt.Id)); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	backoff := q.Backoff << uint(evt.Attempts-1)
+	if backoff <= 0 || backoff > queueMaxBackoff {
+		backoff = queueMaxBackoff
+	}
+	evt.NextAttempt = time.Now().Add(backoff)
+	if err = q.write(queuePending, evt); err != nil {
+		log.Println(err)
+	}
+}
+
+// DeadLetters 死信列表
+func (q *EventQueue) DeadLetters() (events []QueuedEvent, err error) {
+	ids, err := q.list(queueDead)
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		evt, err := q.read(queueDead, id)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, evt)
+	}
+	return
+}
+
+// Requeue 把死信重新放回队列
+func (q *EventQueue) Requeue(id string) (err error) {
+	if !queueIdPattern.MatchString(id) {
+		return errors.New("invalid event id")
+	}
+
+	evt, err := q.read(queueDead, id)
+	if err != nil {
+		return
+	}
+
+	evt.Attempts = 0
+	evt.LastError = ""
+	evt.NextAttempt = time.Now()
+	if err = q.write(queuePending, evt); err != nil {
+		return
+	}
+	if err = os.Remove(q.path(queueDead, id)); err != nil {
+		return
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return
+}
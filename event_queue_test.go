@@ -0,0 +1,142 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestEventQueue(t *testing.T, handler func(ctx context.Context, evt map[string]interface{}) error) *EventQueue {
+	dir, err := ioutil.TempDir("", "event-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	dispatcher := NewEventDispatcher()
+	On(dispatcher, "user_add_org", handler)
+	queue, err := NewEventQueue(dir, func(app string) *EventDispatcher {
+		if app == "" {
+			return dispatcher
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+func TestEventQueueEnqueueDedupe(t *testing.T) {
+	queue := newTestEventQueue(t, func(ctx context.Context, evt map[string]interface{}) error { return nil })
+
+	payload := []byte(`{"EventType":"user_add_org","CorpId":"corp","UserId":["u1"],"TimeStamp":"1"}`)
+	for i := 0; i < 2; i++ {
+		if err := queue.Enqueue("", "user_add_org", payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := queue.list(queuePending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("pending = %v, want 1 event", ids)
+	}
+}
+
+func TestEventQueueRetryAndDeadLetter(t *testing.T) {
+	fail := true
+	queue := newTestEventQueue(t, func(ctx context.Context, evt map[string]interface{}) error {
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	queue.MaxAttempts = 2
+
+	if err := queue.enqueue("", "user_add_org", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	ids, _ := queue.list(queuePending)
+	if len(ids) != 1 {
+		t.Fatalf("pending = %v", ids)
+	}
+	id := ids[0]
+
+	// 第一次失败：留在 pending，按退避推迟下次执行
+	evt, _ := queue.read(queuePending, id)
+	queue.process(context.Background(), evt)
+	evt, err := queue.read(queuePending, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt.Attempts != 1 || evt.LastError == "" || !evt.NextAttempt.After(time.Now()) {
+		t.Fatalf("after first failure: %+v", evt)
+	}
+
+	// 达到 MaxAttempts 后进入死信
+	queue.process(context.Background(), evt)
+	if _, err := queue.read(queuePending, id); !os.IsNotExist(err) {
+		t.Fatalf("event still pending: %v", err)
+	}
+	dead, err := queue.DeadLetters()
+	if err != nil || len(dead) != 1 || dead[0].Id != id {
+		t.Fatalf("DeadLetters = %v, %v", dead, err)
+	}
+
+	// Requeue 后重置次数，处理成功后删除
+	if err := queue.Requeue(id); err != nil {
+		t.Fatal(err)
+	}
+	evt, err = queue.read(queuePending, id)
+	if err != nil || evt.Attempts != 0 || evt.LastError != "" {
+		t.Fatalf("after Requeue: %+v, %v", evt, err)
+	}
+	fail = false
+	queue.process(context.Background(), evt)
+	if ids, _ := queue.list(queuePending); len(ids) != 0 {
+		t.Fatalf("pending = %v after success", ids)
+	}
+}
+
+func TestEventQueueUnknownApp(t *testing.T) {
+	queue := newTestEventQueue(t, func(ctx context.Context, evt map[string]interface{}) error { return nil })
+	if err := queue.enqueue("missing", "user_add_org", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	ids, _ := queue.list(queuePending)
+	evt, _ := queue.read(queuePending, ids[0])
+	queue.process(context.Background(), evt)
+
+	evt, err := queue.read(queuePending, ids[0])
+	if err != nil || evt.Attempts != 1 {
+		t.Fatalf("event for unconfigured app: %+v, %v", evt, err)
+	}
+}
+
+func TestEventQueueRequeueInvalidId(t *testing.T) {
+	queue := newTestEventQueue(t, func(ctx context.Context, evt map[string]interface{}) error { return nil })
+	for _, id := range []string{"", "../pending/1-1", "abc"} {
+		if err := queue.Requeue(id); err == nil {
+			t.Errorf("Requeue(%q) accepted", id)
+		}
+	}
+}
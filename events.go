@@ -0,0 +1,204 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// EventHeader 所有回调事件的公共字段
+type EventHeader struct {
+	EventType string      `json:"EventType"`
+	TimeStamp json.Number `json:"TimeStamp"`
+	CorpId    string      `json:"CorpId"`
+}
+
+// 通讯录 用户事件
+// user_add_org / user_modify_org / user_leave_org / user_active_org
+// org_admin_add / org_admin_remove
+type UserEvent struct {
+	EventHeader
+	UserId []string `json:"UserId"`
+}
+
+type UserAddOrgEvent = UserEvent
+type UserModifyOrgEvent = UserEvent
+type UserLeaveOrgEvent = UserEvent
+type UserActiveOrgEvent = UserEvent
+type OrgAdminAddEvent = UserEvent
+type OrgAdminRemoveEvent = UserEvent
+
+// 通讯录 部门事件
+// org_dept_create / org_dept_modify / org_dept_remove
+type DeptEvent struct {
+	EventHeader
+	DeptId []int64 `json:"DeptId"`
+}
+
+type OrgDeptCreateEvent = DeptEvent
+type OrgDeptModifyEvent = DeptEvent
+type OrgDeptRemoveEvent = DeptEvent
+
+// 企业事件 org_remove / org_change
+type OrgEvent struct {
+	EventHeader
+}
+
+// 审批实例事件 bpms_instance_change
+type BpmsInstanceChangeEvent struct {
+	EventHeader
+	ProcessInstanceId string `json:"processInstanceId"`
+	ProcessCode       string `json:"processCode"`
+	Title             string `json:"title"`
+	Type              string `json:"type"`   // start / finish / terminate
+	Result            string `json:"result"` // agree / refuse
+	StaffId           string `json:"staffId"`
+	Url               string `json:"url"`
+	CreateTime        int64  `json:"createTime"`
+	FinishTime        int64  `json:"finishTime"`
+	BizCategoryId     string `json:"bizCategoryId"`
+}
+
+// 审批任务事件 bpms_task_change
+type BpmsTaskChangeEvent struct {
+	EventHeader
+	ProcessInstanceId string `json:"processInstanceId"`
+	ProcessCode       string `json:"processCode"`
+	Title             string `json:"title"`
+	Type              string `json:"type"`   // start / finish / cancel
+	Result            string `json:"result"` // agree / refuse / redirect
+	Remark            string `json:"remark"`
+	StaffId           string `json:"staffId"`
+	ActivityId        string `json:"activityId"`
+	CreateTime        int64  `json:"createTime"`
+	FinishTime        int64  `json:"finishTime"`
+	BizCategoryId     string `json:"bizCategoryId"`
+}
+
+// 群会话事件
+// chat_add_member / chat_remove_member / chat_quit / chat_update_owner / chat_update_title / chat_disband
+type ChatEvent struct {
+	EventHeader
+	ChatId          string   `json:"ChatId"`
+	Operator        string   `json:"Operator"`
+	OperatorUnionId string   `json:"OperatorUnionId"`
+	UserId          []string `json:"UserId"`
+	Title           string   `json:"Title"`
+	Owner           string   `json:"Owner"`
+}
+
+type ChatAddMemberEvent = ChatEvent
+type ChatRemoveMemberEvent = ChatEvent
+type ChatQuitEvent = ChatEvent
+type ChatUpdateOwnerEvent = ChatEvent
+type ChatUpdateTitleEvent = ChatEvent
+type ChatDisbandEvent = ChatEvent
+
+// 考勤打卡事件 attendance_check_record
+type AttendanceCheckRecordEvent struct {
+	EventHeader
+	DataList []struct {
+		BizId          string  `json:"bizId"`
+		CorpId         string  `json:"corpId"`
+		UserId         string  `json:"userId"`
+		DeviceId       string  `json:"deviceId"`
+		DeviceName     string  `json:"deviceName"`
+		CheckTime      int64   `json:"checkTime"`
+		Address        string  `json:"address"`
+		LocationMethod string  `json:"locationMethod"`
+		LocationResult string  `json:"locationResult"`
+		Latitude       float64 `json:"latitude"`
+		Longitude      float64 `json:"longitude"`
+	} `json:"DataList"`
+}
+
+// 考勤排班变更事件 attendance_schedule_change
+type AttendanceScheduleChangeEvent struct {
+	EventHeader
+	DataList []struct {
+		CorpId    string `json:"corpId"`
+		UserId    string `json:"userId"`
+		PlanId    int64  `json:"planId"`
+		ClassId   int64  `json:"classId"`
+		CheckType string `json:"checkType"`
+		CheckTime int64  `json:"planCheckTime"`
+	} `json:"DataList"`
+}
+
+// 员工加班事件 attendance_overtime_duration
+type AttendanceOvertimeDurationEvent struct {
+	EventHeader
+	DataList []struct {
+		CorpId   string  `json:"corpId"`
+		UserId   string  `json:"userId"`
+		BizId    string  `json:"bizId"`
+		Duration float64 `json:"duration"`
+		Date     int64   `json:"date"`
+	} `json:"DataList"`
+}
+
+// 事件处理函数：payload 为解密后的事件 json
+type eventHandler func(ctx context.Context, payload []byte) error
+
+// EventDispatcher 按 EventType 分发回调事件
+type EventDispatcher struct {
+	mu       sync.RWMutex
+	handlers map[string][]eventHandler
+}
+
+func NewEventDispatcher() *EventDispatcher {
+	return &EventDispatcher{handlers: map[string][]eventHandler{}}
+}
+
+// DefaultDispatcher 根回调 Callback 使用的分发器
+var DefaultDispatcher = NewEventDispatcher()
+
+// On 在分发器 d 上注册 eventType 的处理函数，事件 json 解析为 T 后回调
+func On[T any](d *EventDispatcher, eventType string, handler func(ctx context.Context, evt T) error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.handlers[eventType] = append(d.handlers[eventType], func(ctx context.Context, payload []byte) error {
+		var evt T
+		if err := json.Unmarshal(payload, &evt); err != nil {
+			return fmt.Errorf("unmarshal %s: %w", eventType, err)
+		}
+		return handler(ctx, evt)
+	})
+}
+
+// OnEvent 在 DefaultDispatcher 上注册事件处理函数
+//
+//	OnEvent("user_add_org", func(ctx context.Context, evt UserAddOrgEvent) error { ... })
+func OnEvent[T any](eventType string, handler func(ctx context.Context, evt T) error) {
+	On(DefaultDispatcher, eventType, handler)
+}
+
+// Dispatch 依次执行 eventType 的处理函数，返回第一个错误；未注册的事件直接忽略
+func (d *EventDispatcher) Dispatch(ctx context.Context, eventType string, payload []byte) error {
+	d.mu.RLock()
+	handlers := d.handlers[eventType]
+	d.mu.RUnlock()
+
+	for _, handler := range handlers {
+		if err := handler(ctx, payload); err != nil {
+			return fmt.Errorf("handle %s: %w", eventType, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,389 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ForwardedEvent 转发给订阅方的事件
+type ForwardedEvent struct {
+	Id        string          `json:"id"`
+	App       string          `json:"app"`
+	EventType string          `json:"event_type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// EventSink 事件转发目标
+type EventSink interface {
+	Publish(ctx context.Context, evt ForwardedEvent) error
+}
+
+// Publisher NATS / Kafka 风格的消息发布接口，接入消息队列时实现该接口即可
+type Publisher interface {
+	Publish(ctx context.Context, subject string, data []byte) error
+}
+
+// PublisherSink 发布到 Publisher，Subject 为空时使用 dingding.<app>.<event_type>
+type PublisherSink struct {
+	Publisher Publisher
+	Subject   string
+}
+
+func (s *PublisherSink) Publish(ctx context.Context, evt ForwardedEvent) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+
+	subject := s.Subject
+	if len(subject) == 0 {
+		subject = "dingding." + evt.App + "." + evt.EventType
+	}
+	return s.Publisher.Publish(ctx, subject, data)
+}
+
+// BrokerMessage 进程内 broker 消息
+type BrokerMessage struct {
+	Subject string
+	Data    []byte
+}
+
+// LocalBroker 进程内 broker，实现 Publisher，可替代 NATS / Kafka 用于本地开发
+type LocalBroker struct {
+	mu   sync.RWMutex
+	subs map[string][]*brokerSub
+}
+
+// 单个订阅：取消时先关闭 done 唤醒阻塞的发送方，再在写锁下关闭 ch，避免向已关闭的 ch 发送
+type brokerSub struct {
+	ch   chan BrokerMessage
+	done chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func (s *brokerSub) send(ctx context.Context, msg BrokerMessage) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil
+	}
+	select {
+	case s.ch <- msg:
+	case <-s.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *brokerSub) close() {
+	close(s.done)
+
+	s.mu.Lock()
+	s.closed = true
+	close(s.ch)
+	s.mu.Unlock()
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{subs: map[string][]*brokerSub{}}
+}
+
+// Subscribe 订阅 subject，"*" 订阅全部；返回的函数用于取消订阅
+func (b *LocalBroker) Subscribe(subject string, buffer int) (<-chan BrokerMessage, func()) {
+	sub := &brokerSub{ch: make(chan BrokerMessage, buffer), done: make(chan struct{})}
+
+	b.mu.Lock()
+	b.subs[subject] = append(b.subs[subject], sub)
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			subs := b.subs[subject]
+			for i, s := range subs {
+				if s == sub {
+					// 复制而不是原地删除，Publish 持有的快照不受影响
+					remaining := make([]*brokerSub, 0, len(subs)-1)
+					remaining = append(remaining, subs[:i]...)
+					b.subs[subject] = append(remaining, subs[i+1:]...)
+					break
+				}
+			}
+			b.mu.Unlock()
+
+			sub.close()
+		})
+	}
+}
+
+// Publish 在锁内复制订阅列表，发送时不持有锁，慢订阅方不会阻塞 Subscribe / 取消订阅
+func (b *LocalBroker) Publish(ctx context.Context, subject string, data []byte) error {
+	b.mu.RLock()
+	targets := make([]*brokerSub, 0, len(b.subs[subject])+len(b.subs["*"]))
+	targets = append(targets, b.subs[subject]...)
+	targets = append(targets, b.subs["*"]...)
+	b.mu.RUnlock()
+
+	msg := BrokerMessage{Subject: subject, Data: data}
+	for _, sub := range targets {
+		if err := sub.send(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebhookSink 以 HMAC-SHA256 签名 POST 到订阅方
+// X-Dingding-Signature = hex(hmac_sha256(Secret, X-Dingding-Timestamp + "." + body))
+type WebhookSink struct {
+	Url         string
+	Secret      string
+	MaxAttempts int
+	Backoff     time.Duration
+	Client      *http.Client
+}
+
+// WebhookSignature 订阅方用于校验签名
+func WebhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *WebhookSink) post(ctx context.Context, evt ForwardedEvent, body []byte) (err error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dingding-Event", evt.EventType)
+	req.Header.Set("X-Dingding-Event-Id", evt.Id)
+	req.Header.Set("X-Dingding-Timestamp", timestamp)
+	req.Header.Set("X-Dingding-Signature", WebhookSignature(s.Secret, timestamp, body))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded %d", s.Url, resp.StatusCode)
+	}
+	return
+}
+
+// Publish 失败按指数退避重试 MaxAttempts 次
+func (s *WebhookSink) Publish(ctx context.Context, evt ForwardedEvent) (err error) {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+
+	backoff := s.Backoff
+	for attempt := 1; ; attempt++ {
+		if err = s.post(ctx, evt, body); err == nil || attempt >= s.MaxAttempts {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Subscriber 订阅方，Events / Apps 为空时不过滤
+type Subscriber struct {
+	Name   string
+	Events []string
+	Apps   []string
+	Sink   EventSink
+
+	// 待投递的事件，每个订阅方一个持久化队列
+	queue *EventQueue
+}
+
+func contains(items []string, item string) bool {
+	for _, v := range items {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Subscriber) Match(app string, eventType string) bool {
+	return (len(s.Apps) == 0 || contains(s.Apps, app)) && (len(s.Events) == 0 || contains(s.Events, eventType))
+}
+
+// Forwarder 按 EventType 把事件扇出给订阅方
+type Forwarder struct {
+	Subscribers []*Subscriber
+	// 单次投递超时
+	Timeout time.Duration
+}
+
+// Forward 写入匹配的订阅方队列后返回，不阻塞回调与事件处理；由 Start 启动的 worker 投递
+func (f *Forwarder) Forward(evt QueuedEvent) {
+	for _, subscriber := range f.Subscribers {
+		if !subscriber.Match(evt.App, evt.EventType) {
+			continue
+		}
+
+		err := subscriber.queue.push(QueuedEvent{
+			Id:          evt.Id,
+			App:         evt.App,
+			EventType:   evt.EventType,
+			Payload:     evt.Payload,
+			CreatedAt:   evt.CreatedAt,
+			NextAttempt: time.Now(),
+		})
+		if err != nil {
+			log.Printf("forward event %s %s to %s failed: %s", evt.Id, evt.EventType, subscriber.Name, err)
+		}
+	}
+}
+
+// Start 每个订阅方启动一个 worker 按顺序投递，失败按指数退避重试，超过次数进入该订阅方的死信
+func (f *Forwarder) Start(ctx context.Context) {
+	for _, subscriber := range f.Subscribers {
+		subscriber.queue.Start(ctx)
+	}
+}
+
+func (f *Forwarder) deliver(subscriber *Subscriber) func(ctx context.Context, evt QueuedEvent) error {
+	return func(ctx context.Context, evt QueuedEvent) error {
+		ctx, cancel := context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+
+		return subscriber.Sink.Publish(ctx, ForwardedEvent{
+			Id:        evt.Id,
+			App:       evt.App,
+			EventType: evt.EventType,
+			Payload:   evt.Payload,
+			CreatedAt: evt.CreatedAt,
+		})
+	}
+}
+
+// 订阅配置，ForwardConfig 指定的 json 文件：
+//
+//	[
+//	  {"name": "hr", "type": "webhook", "url": "https://hr.example.com/dingding", "secret": "xxx", "events": ["user_add_org"]},
+//	  {"name": "bus", "type": "broker", "subject": "", "apps": ["default"]}
+//	]
+type subscriberConfig struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Url         string   `json:"url"`
+	Secret      string   `json:"secret"`
+	Subject     string   `json:"subject"`
+	Events      []string `json:"events"`
+	Apps        []string `json:"apps"`
+	MaxAttempts int      `json:"max_attempts"`
+}
+
+var subscriberNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// 加载订阅配置，文件不存在时不转发；broker 类型发布到进程内 broker
+// 每个订阅方的待投递事件保存在 <dir>/<name>，进程重启后继续投递
+func loadForwarder(path string, dir string, broker Publisher) (forwarder *Forwarder, err error) {
+	forwarder = &Forwarder{Timeout: time.Minute}
+	if len(path) == 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return forwarder, nil
+	}
+	if err != nil {
+		return
+	}
+
+	var configs []subscriberConfig
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	names := map[string]bool{}
+	for _, config := range configs {
+		// name 用作队列目录
+		if !subscriberNamePattern.MatchString(config.Name) || names[config.Name] {
+			return nil, fmt.Errorf("subscriber %q: name must be unique and match %s", config.Name, subscriberNamePattern)
+		}
+		names[config.Name] = true
+
+		subscriber := &Subscriber{Name: config.Name, Events: config.Events, Apps: config.Apps}
+		switch config.Type {
+		case "webhook":
+			// 由队列重试，单次投递只 POST 一次
+			subscriber.Sink = &WebhookSink{
+				Url:         config.Url,
+				Secret:      config.Secret,
+				MaxAttempts: 1,
+				Client:      &http.Client{Timeout: 10 * time.Second},
+			}
+		case "broker":
+			subscriber.Sink = &PublisherSink{Publisher: broker, Subject: config.Subject}
+		default:
+			return nil, fmt.Errorf("subscriber %s: unknown type %q", config.Name, config.Type)
+		}
+
+		if subscriber.queue, err = NewEventQueue(filepath.Join(dir, config.Name), nil); err != nil {
+			return nil, err
+		}
+		subscriber.queue.Handler = forwarder.deliver(subscriber)
+		subscriber.queue.Workers = 1
+		if config.MaxAttempts > 0 {
+			subscriber.queue.MaxAttempts = config.MaxAttempts
+		} else {
+			subscriber.queue.MaxAttempts = 5
+		}
+
+		forwarder.Subscribers = append(forwarder.Subscribers, subscriber)
+	}
+	return
+}
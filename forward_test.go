@@ -0,0 +1,208 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLocalBrokerPublish(t *testing.T) {
+	broker := NewLocalBroker()
+	exact, cancelExact := broker.Subscribe("dingding.app.user_add_org", 1)
+	defer cancelExact()
+	all, cancelAll := broker.Subscribe("*", 1)
+	defer cancelAll()
+
+	if err := broker.Publish(context.Background(), "dingding.app.user_add_org", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-exact; string(msg.Data) != "x" {
+		t.Fatalf("exact subscriber got %q", msg.Data)
+	}
+	if msg := <-all; msg.Subject != "dingding.app.user_add_org" {
+		t.Fatalf("wildcard subscriber got %q", msg.Subject)
+	}
+}
+
+// 订阅方不读取时，取消订阅不被阻塞中的 Publish 卡住
+func TestLocalBrokerUnsubscribeWhilePublishing(t *testing.T) {
+	broker := NewLocalBroker()
+	_, cancel := broker.Subscribe("s", 0)
+
+	published := make(chan error)
+	go func() {
+		published <- broker.Publish(context.Background(), "s", []byte("x"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	unsubscribed := make(chan struct{})
+	go func() {
+		cancel()
+		close(unsubscribed)
+	}()
+
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("unsubscribe blocked by pending publish")
+	}
+	if err := <-published; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 并发发布、订阅、取消订阅，配合 go test -race
+func TestLocalBrokerConcurrent(t *testing.T) {
+	broker := NewLocalBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ch, unsubscribe := broker.Subscribe("s", 1)
+				go func() {
+					for range ch {
+					}
+				}()
+				unsubscribe()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := broker.Publish(ctx, "s", []byte("x")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func writeForwardConfig(t *testing.T, configs []subscriberConfig) (path string, dir string) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	data, err := json.Marshal(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "forward.json")
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, filepath.Join(dir, "queues")
+}
+
+func TestForwarderPersistsDeliveries(t *testing.T) {
+	var status int32 = http.StatusInternalServerError
+	received := make(chan ForwardedEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var evt ForwardedEvent
+		_ = json.NewDecoder(r.Body).Decode(&evt)
+		received <- evt
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	path, dir := writeForwardConfig(t, []subscriberConfig{
+		{Name: "hr", Type: "webhook", Url: server.URL, Events: []string{"user_add_org"}},
+	})
+	forwarder, err := loadForwarder(path, dir, NewLocalBroker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := forwarder.Subscribers[0].queue
+
+	evt := QueuedEvent{Id: "1-1", EventType: "user_add_org", Payload: []byte(`{}`), CreatedAt: time.Now()}
+	forwarder.Forward(evt)
+	forwarder.Forward(QueuedEvent{Id: "1-2", EventType: "org_dept_create", Payload: []byte(`{}`)})
+	if ids, _ := queue.list(queuePending); len(ids) != 1 || ids[0] != evt.Id {
+		t.Fatalf("pending = %v, want [%s]", ids, evt.Id)
+	}
+
+	// 投递失败留在 pending 等待重试
+	pending, _ := queue.read(queuePending, evt.Id)
+	queue.process(context.Background(), pending)
+	<-received
+	if pending, err = queue.read(queuePending, evt.Id); err != nil || pending.Attempts != 1 {
+		t.Fatalf("after failure: %+v, %v", pending, err)
+	}
+
+	// 重新加载（进程重启）后继续投递
+	atomic.StoreInt32(&status, http.StatusOK)
+	pending.NextAttempt = time.Now()
+	if err = queue.write(queuePending, pending); err != nil {
+		t.Fatal(err)
+	}
+	forwarder, err = loadForwarder(path, dir, NewLocalBroker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	forwarder.Start(ctx)
+
+	select {
+	case got := <-received:
+		if got.Id != evt.Id || got.EventType != evt.EventType {
+			t.Fatalf("received %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered after restart")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ids, _ := forwarder.Subscribers[0].queue.list(queuePending)
+		if len(ids) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pending = %v after delivery", ids)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoadForwarderSubscriberName(t *testing.T) {
+	for _, names := range [][]string{{""}, {"../hr"}, {"hr", "hr"}} {
+		var configs []subscriberConfig
+		for _, name := range names {
+			configs = append(configs, subscriberConfig{Name: name, Type: "broker"})
+		}
+		path, dir := writeForwardConfig(t, configs)
+		if _, err := loadForwarder(path, dir, NewLocalBroker()); err == nil {
+			t.Fatalf("names %q accepted", names)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/fastwego/dingding-demo
+
+go 1.18
@@ -29,7 +29,7 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/faabiosr/cachego/file"
+	"github.com/fastwego/dingding-demo/tokencache"
 
 	"github.com/fastwego/dingding"
 
@@ -42,6 +42,8 @@ import (
 
 var DingClient *dingding.Client
 var DingConfig map[string]string
+var TokenRefresher *tokencache.Refresher
+var TokenAudits *tokencache.AuditLog
 
 func init() {
 	// 加载配置文件
@@ -55,6 +57,8 @@ func init() {
 		"AppSecret":      viper.GetString("AppSecret"),
 		"Token":          viper.GetString("TOKEN"),
 		"EncodingAESKey": viper.GetString("EncodingAESKey"),
+
+		"AdminToken": viper.GetString("AdminToken"),
 	}
 
 	// 钉钉 AccessToken 管理器
@@ -69,13 +73,18 @@ func init() {
 
 			return req
 		},
-		Cache: file.New(os.TempDir()),
 	}
 
 	// 钉钉 客户端
 	DingClient = dingding.NewClient(atm)
 
-	atm.Cache = file.New(os.TempDir())
+	// access_token 缓存、后台刷新与吊销后重试，后端由 TokenCache 配置
+	var err error
+	TokenRefresher, TokenAudits, DingClient.HTTPClient, err = tokencache.Setup(atm)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 }
 
 func main() {
@@ -89,6 +98,10 @@ func main() {
 
 	router.GET("/", Index)
 
+	// 管理接口：access_token 查看、强制刷新
+	admin := router.Group("/admin", tokencache.AdminAuth(DingConfig["AdminToken"]))
+	tokencache.NewAdmin(TokenRefresher, TokenAudits).RegisterRoutes(admin)
+
 	svr := &http.Server{
 		Addr:    viper.GetString("LISTEN"),
 		Handler: router,
@@ -101,6 +114,11 @@ func main() {
 		}
 	}()
 
+	// 过期前后台刷新 access_token
+	refreshCtx, stopRefresh := context.WithCancel(context.Background())
+	defer stopRefresh()
+	go TokenRefresher.Start(refreshCtx)
+
 	quit := make(chan os.Signal)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -0,0 +1,123 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loginsession 登录态保存在服务端，cookie 中只有随机 id
+//
+// 登录成功时总是签发新的 id 并作废请求带来的旧 id，
+// 登录前被植入的 session id 无法在登录后继续使用（session 固定攻击）
+package loginsession
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// Store 登录态，保存在内存中，重启后需重新登录
+type Store struct {
+	Name   string // cookie 名
+	MaxAge time.Duration
+	Secure bool // 仅 https 下发送 cookie
+
+	mu       sync.Mutex
+	sessions map[string]entry
+}
+
+func NewStore(name string, maxAge time.Duration, secure bool) *Store {
+	return &Store{Name: name, MaxAge: maxAge, Secure: secure, sessions: map[string]entry{}}
+}
+
+func newId() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// 调用方持有锁
+func (s *Store) purge(now time.Time) {
+	for id, e := range s.sessions {
+		if now.After(e.expiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Login 登录成功：作废旧 id，以新 id 保存登录用户并写入 cookie
+func (s *Store) Login(w http.ResponseWriter, r *http.Request, value interface{}) error {
+	id, err := newId()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.purge(time.Now())
+	if c, err := r.Cookie(s.Name); err == nil {
+		delete(s.sessions, c.Value)
+	}
+	s.sessions[id] = entry{value: value, expiresAt: time.Now().Add(s.MaxAge)}
+	s.mu.Unlock()
+
+	s.setCookie(w, id, int(s.MaxAge/time.Second))
+	return nil
+}
+
+// Get 当前登录用户
+func (s *Store) Get(r *http.Request) (interface{}, bool) {
+	c, err := r.Cookie(s.Name)
+	if err != nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.sessions[c.Value]
+	if !ok || time.Now().After(e.expiresAt) {
+		delete(s.sessions, c.Value)
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Logout 作废登录态并清除 cookie
+func (s *Store) Logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(s.Name); err == nil {
+		s.mu.Lock()
+		delete(s.sessions, c.Value)
+		s.mu.Unlock()
+	}
+	s.setCookie(w, "", -1)
+}
+
+func (s *Store) setCookie(w http.ResponseWriter, id string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.Name,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   s.Secure,
+		HttpOnly: true,
+		// 钉钉扫码后是顶层跳转回来，Lax 下 cookie 仍会带上
+		SameSite: http.SameSiteLaxMode,
+	})
+}
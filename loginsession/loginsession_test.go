@@ -0,0 +1,101 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loginsession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func login(t *testing.T, s *Store, r *http.Request, value interface{}) *http.Cookie {
+	w := httptest.NewRecorder()
+	if err := s.Login(w, r, value); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != s.Name || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %+v", cookies)
+	}
+	return cookies[0]
+}
+
+func request(cookie *http.Cookie) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func TestLoginIssuesNewId(t *testing.T) {
+	s := NewStore("login", time.Hour, false)
+
+	// 攻击者先登录自己的账号，把 cookie 植入受害者浏览器
+	planted := login(t, s, request(nil), "attacker")
+
+	// 受害者带着植入的 cookie 登录，得到新的 id
+	victim := login(t, s, request(planted), "victim")
+	if victim.Value == planted.Value {
+		t.Fatal("session id not renewed on login")
+	}
+	if value, ok := s.Get(request(victim)); !ok || value != "victim" {
+		t.Fatalf("Get = %v, %v", value, ok)
+	}
+
+	// 植入的 id 已作废，拿不到受害者的登录态
+	if value, ok := s.Get(request(planted)); ok {
+		t.Fatalf("planted id still valid: %v", value)
+	}
+}
+
+func TestGetWithoutCookie(t *testing.T) {
+	s := NewStore("login", time.Hour, false)
+	if _, ok := s.Get(request(nil)); ok {
+		t.Fatal("Get without cookie")
+	}
+	if _, ok := s.Get(request(&http.Cookie{Name: "login", Value: "unknown"})); ok {
+		t.Fatal("Get with unknown id")
+	}
+}
+
+func TestExpired(t *testing.T) {
+	s := NewStore("login", time.Hour, false)
+	cookie := &http.Cookie{Name: "login", Value: "id"}
+	s.sessions["id"] = entry{value: "user", expiresAt: time.Now().Add(-time.Second)}
+
+	if _, ok := s.Get(request(cookie)); ok {
+		t.Fatal("expired session returned")
+	}
+	if _, ok := s.sessions["id"]; ok {
+		t.Fatal("expired session not removed")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	s := NewStore("login", time.Hour, false)
+	cookie := login(t, s, request(nil), "user")
+
+	w := httptest.NewRecorder()
+	s.Logout(w, request(cookie))
+	if _, ok := s.Get(request(cookie)); ok {
+		t.Fatal("session valid after logout")
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Fatalf("cookie not cleared: %+v", cookies)
+	}
+}
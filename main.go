@@ -16,7 +16,10 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"expvar"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -24,7 +27,7 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/faabiosr/cachego/file"
+	"github.com/fastwego/dingding-demo/tokencache"
 
 	"github.com/fastwego/dingding"
 	"github.com/spf13/viper"
@@ -32,14 +35,43 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-var DingClient *dingding.Client
 var DingConfig map[string]string
 
-func init() {
-	// 加载配置文件
+// App 根 demo 的依赖，由 setup 按 .env 创建后传给各处理函数
+type App struct {
+	Client    *dingding.Client
+	Refresher *tokencache.Refresher
+	Audits    *tokencache.AuditLog
+	Registrar *CallBackRegistrar
+
+	Apps      CallbackApps
+	Events    *EventQueue
+	Forwarder *Forwarder
+	Failed    *FailedEvents
+
+	// 进程内 broker，可订阅转发的事件
+	Broker *LocalBroker
+
+	DB        *sql.DB
+	Directory *Directory
+	Approvals *Approvals
+}
+
+// 加载配置文件
+func loadConfig() {
 	viper.SetConfigFile(".env")
 	_ = viper.ReadInConfig()
 
+	viper.SetDefault("FailedCursorFile", "callback_failed.json")
+	viper.SetDefault("EventQueueDir", "events")
+	viper.SetDefault("EventQueueWorkers", 4)
+	viper.SetDefault("EventQueueMaxAttempts", 8)
+	viper.SetDefault("DedupeTTL", "24h")
+	viper.SetDefault("DedupeDir", "dedupe")
+	viper.SetDefault("SQLitePath", "dingding-demo.db")
+	viper.SetDefault("ForwardConfig", "forward.json")
+	viper.SetDefault("ForwardQueueDir", "forward")
+
 	DingConfig = map[string]string{
 		"CorpId":         viper.GetString("CorpId"),
 		"AgentId":        viper.GetString("AgentId"),
@@ -47,8 +79,18 @@ func init() {
 		"AppSecret":      viper.GetString("AppSecret"),
 		"Token":          viper.GetString("TOKEN"),
 		"EncodingAESKey": viper.GetString("EncodingAESKey"),
+		"CallbackUrl":    viper.GetString("CallbackUrl"),
+		"CallbackTags":   viper.GetString("CallbackTags"),
+
+		"FailedCursorFile":   viper.GetString("FailedCursorFile"),
+		"FailedPollInterval": viper.GetString("FailedPollInterval"),
+
+		"AdminToken": viper.GetString("AdminToken"),
 	}
+}
 
+// 钉钉客户端
+func newDingClient() (client *dingding.Client, refresher *tokencache.Refresher, audits *tokencache.AuditLog, err error) {
 	// 钉钉 AccessToken 管理器
 	atm := &dingding.DefaultAccessTokenManager{
 		Id:   DingConfig["AppKey"],
@@ -61,17 +103,84 @@ func init() {
 
 			return req
 		},
-		Cache: file.New(os.TempDir()),
 	}
 
 	// 钉钉 客户端
-	DingClient = dingding.NewClient(atm)
+	client = dingding.NewClient(atm)
 
-	atm.Cache = file.New(os.TempDir())
+	// access_token 缓存、后台刷新与吊销后重试，后端由 TokenCache 配置
+	refresher, audits, client.HTTPClient, err = tokencache.Setup(atm)
+	return
 }
 
-func main() {
+// 事件队列：去重后写入 EventQueueDir，新事件按 ForwardConfig 写入各订阅方在 ForwardQueueDir 下的队列
+func newEvents(apps CallbackApps, broker Publisher) (events *EventQueue, forwarder *Forwarder, err error) {
+	events, err = NewEventQueue(viper.GetString("EventQueueDir"), apps.Dispatcher)
+	if err != nil {
+		return
+	}
+	events.Workers = viper.GetInt("EventQueueWorkers")
+	events.MaxAttempts = viper.GetInt("EventQueueMaxAttempts")
+
+	// 事件去重
+	events.Dedupe, err = newDedupeStore(viper.GetString("DedupeStore"))
+	if err != nil {
+		return
+	}
+	events.DedupeTTL = viper.GetDuration("DedupeTTL")
+
+	// 事件转发
+	forwarder, err = loadForwarder(viper.GetString("ForwardConfig"), viper.GetString("ForwardQueueDir"), broker)
+	if err != nil {
+		return
+	}
+	events.OnEnqueued = forwarder.Forward
+	return
+}
+
+// 通讯录镜像与审批跟踪，事件处理函数注册到 DefaultDispatcher
+func openStores(client *dingding.Client) (db *sql.DB, directory *Directory, approvals *Approvals, err error) {
+	db, err = openDB(viper.GetString("SQLitePath"))
+	if err != nil {
+		return
+	}
+
+	directory, err = NewDirectory(db, client)
+	if err != nil {
+		return
+	}
+	directory.RegisterHandlers(DefaultDispatcher)
+
+	approvals, err = NewApprovals(db, client)
+	if err != nil {
+		return
+	}
+	approvals.RegisterHandlers(DefaultDispatcher)
+	return
+}
+
+// 创建服务依赖：缓存、事件队列目录、本地数据库
+func setup() (app *App, err error) {
+	app = &App{Broker: NewLocalBroker()}
+
+	if app.Client, app.Refresher, app.Audits, err = newDingClient(); err != nil {
+		return
+	}
+	app.Registrar = newCallBackRegistrar(app.Client)
+
+	// 回调应用 & 事件队列
+	app.Apps = loadCallbackApps()
+	if app.Events, app.Forwarder, err = newEvents(app.Apps, app.Broker); err != nil {
+		return
+	}
+	app.Failed = NewFailedEvents(app.Client, app.Events, DingConfig["FailedCursorFile"])
 
+	app.DB, app.Directory, app.Approvals, err = openStores(app.Client)
+	return
+}
+
+// 路由
+func (app *App) routes() *gin.Engine {
 	router := gin.New()
 	router.Use(gin.Logger(), gin.Recovery())
 
@@ -81,7 +190,7 @@ func main() {
 		params.Add("mobile", "13800138000")
 
 		req, _ := http.NewRequest(http.MethodGet, "/user/get_by_mobile?"+params.Encode(), nil)
-		get, err := DingClient.Do(req)
+		get, err := app.Client.Do(req)
 
 		if err != nil {
 			log.Println(err)
@@ -91,24 +200,108 @@ func main() {
 	})
 
 	// 事件回调
-	router.POST("/api/dingding/callback", Callback)
+	router.POST("/api/dingding/callback", Callback(app.Apps, app.Events))
+	router.POST("/api/dingding/callback/:app", Callback(app.Apps, app.Events))
+
+	// 管理接口：事件队列死信 & 回调计数
+	adminAuth := tokencache.AdminAuth(DingConfig["AdminToken"])
+	admin := router.Group("/admin", adminAuth)
+	admin.GET("/events/dead", DeadEvents(app.Events))
+	admin.POST("/events/dead/:id/requeue", RequeueDeadEvent(app.Events))
+	admin.GET("/metrics", gin.WrapH(expvar.Handler()))
+
+	// access_token 查看、强制刷新
+	tokencache.NewAdmin(app.Refresher, app.Audits).RegisterRoutes(admin)
+
+	// 通讯录与审批查询含手机号、表单内容等个人信息，与管理接口使用同一鉴权
+	internal := router.Group("", adminAuth)
+	app.Directory.RegisterRoutes(internal)
+	admin.POST("/directory/sync", func(c *gin.Context) {
+		go func() {
+			if err := app.Directory.FullSync(context.Background()); err != nil {
+				log.Println(err)
+			}
+		}()
+		c.JSON(http.StatusAccepted, gin.H{"status": "syncing"})
+	})
+
+	// 审批
+	app.Approvals.RegisterRoutes(internal)
 
 	// 文件上传
-	router.GET("/api/upload/single", UploadSingle)
-	router.GET("/api/upload/chunk", UploadChunk)
+	router.GET("/api/upload/single", UploadSingle(app.Client))
+	router.GET("/api/upload/chunk", UploadChunk(app.Client))
+
+	return router
+}
+
+func main() {
+	loadConfig()
+
+	// 子命令：只创建各自需要的依赖
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
+	app, err := setup()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// 事件处理
+	OnEvent("user_add_org", func(ctx context.Context, evt UserAddOrgEvent) error {
+		log.Println("user_add_org", evt.CorpId, evt.UserId)
+		return nil
+	})
 
 	svr := &http.Server{
 		Addr:    viper.GetString("LISTEN"),
-		Handler: router,
+		Handler: app.routes(),
+	}
+
+	addr := svr.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
 	go func() {
-		err := svr.ListenAndServe()
+		err := svr.Serve(ln)
 		if err != nil && err != http.ErrServerClosed {
 			log.Fatalln(err)
 		}
 	}()
 
+	// 注册事件回调：钉钉会立即推送 check_url 校验，需在监听之后
+	if len(DingConfig["CallbackUrl"]) > 0 {
+		go func() {
+			if err := app.Registrar.Ensure(); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	// 事件队列与转发 worker、access_token 刷新 & 定时拉取推送失败的事件
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	defer stopWorker()
+	app.Events.Start(workerCtx)
+	app.Forwarder.Start(workerCtx)
+	go app.Refresher.Start(workerCtx)
+	if app.Directory.IsEmpty() {
+		go func() {
+			if err := app.Directory.FullSync(workerCtx); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	if interval, err := time.ParseDuration(DingConfig["FailedPollInterval"]); err == nil && interval > 0 {
+		go app.Failed.Poll(workerCtx, interval)
+	}
+
 	quit := make(chan os.Signal)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
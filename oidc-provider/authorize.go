@@ -0,0 +1,237 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fastwego/dingding"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// AuthorizeRequest 进行中的授权请求，扫码登录完成后继续
+type AuthorizeRequest struct {
+	ClientId            string
+	RedirectUri         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// 带上参数跳回客户端，保留 redirect_uri 原有的 query
+func redirectToClient(c *gin.Context, redirectUri string, params url.Values) {
+	u, err := url.Parse(redirectUri)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid redirect_uri")
+		return
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		for _, value := range values {
+			query.Add(key, value)
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	c.Redirect(http.StatusFound, u.String())
+}
+
+func redirectError(c *gin.Context, req AuthorizeRequest, code string, description string) {
+	params := url.Values{}
+	params.Add("error", code)
+	params.Add("error_description", description)
+	if len(req.State) > 0 {
+		params.Add("state", req.State)
+	}
+	redirectToClient(c, req.RedirectUri, params)
+}
+
+// Authorize 授权端点，仅支持 response_type=code
+func Authorize(c *gin.Context) {
+	req := AuthorizeRequest{
+		ClientId:            c.Query("client_id"),
+		RedirectUri:         c.Query("redirect_uri"),
+		Scope:               c.Query("scope"),
+		State:               c.Query("state"),
+		Nonce:               c.Query("nonce"),
+		CodeChallenge:       c.Query("code_challenge"),
+		CodeChallengeMethod: c.Query("code_challenge_method"),
+	}
+
+	// client_id 或 redirect_uri 不合法时不能跳转
+	client, ok := Clients.Get(req.ClientId)
+	if !ok {
+		c.String(http.StatusBadRequest, "unknown client_id")
+		return
+	}
+	if !client.AllowRedirect(req.RedirectUri) {
+		c.String(http.StatusBadRequest, "redirect_uri not registered")
+		return
+	}
+
+	if c.Query("response_type") != "code" {
+		redirectError(c, req, "unsupported_response_type", "only response_type=code is supported")
+		return
+	}
+	if !hasScope(req.Scope, "openid") {
+		redirectError(c, req, "invalid_scope", "scope must contain openid")
+		return
+	}
+	if len(req.CodeChallenge) > 0 {
+		// PKCE 未指定方法时为 plain
+		if len(req.CodeChallengeMethod) == 0 {
+			req.CodeChallengeMethod = "plain"
+		}
+		if req.CodeChallengeMethod != "plain" && req.CodeChallengeMethod != "S256" {
+			redirectError(c, req, "invalid_request", "unsupported code_challenge_method")
+			return
+		}
+	}
+	if client.Public() && req.CodeChallengeMethod != "S256" {
+		redirectError(c, req, "invalid_request", "public client requires code_challenge_method=S256")
+		return
+	}
+
+	if user, ok := loginUser(c); ok && c.Query("prompt") != "login" {
+		issueCode(c, req, user)
+		return
+	}
+
+	// 未登录：记录授权请求，跳转钉钉扫码
+	state, err := randomToken()
+	if err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	session := sessions.Default(c)
+	session.Set("authorize", req)
+	session.Set("state", state)
+	if err = session.Save(); err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	params := url.Values{}
+	params.Add("appid", DingConfig["LoginAppId"])
+	params.Add("response_type", "code")
+	params.Add("scope", "snsapi_login")
+	params.Add("state", state)
+	params.Add("redirect_uri", DingConfig["Issuer"]+"/login/callback")
+
+	c.Redirect(http.StatusFound, dingding.ServerUrl+"/connect/qrconnect?"+params.Encode())
+}
+
+// LoginCallback 钉钉扫码后回跳：校验 state，查询员工信息，继续授权请求
+func LoginCallback(c *gin.Context) {
+	session := sessions.Default(c)
+
+	expected, _ := session.Get("state").(string)
+	req, pending := session.Get("authorize").(AuthorizeRequest)
+	session.Delete("state")
+	session.Delete("authorize")
+
+	state := c.Query("state")
+	if len(expected) == 0 || subtle.ConstantTimeCompare([]byte(state), []byte(expected)) != 1 {
+		_ = session.Save()
+		c.String(http.StatusForbidden, "invalid state")
+		return
+	}
+
+	unionid, err := unionidByCode(c.Query("code"))
+	if err != nil {
+		log.Println(err)
+		_ = session.Save()
+		c.String(http.StatusBadGateway, "login failed")
+		return
+	}
+
+	// 非本企业员工无法登录
+	user, err := userByUnionid(unionid)
+	if err != nil {
+		log.Println(err)
+		_ = session.Save()
+		c.String(http.StatusForbidden, "user not found in organization")
+		return
+	}
+	user.Unionid = unionid
+
+	if err = session.Save(); err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	// 登录成功换发新的 session id
+	if err = Logins.Login(c.Writer, c.Request, user); err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if !pending {
+		c.String(http.StatusOK, "login success")
+		return
+	}
+	issueCode(c, req, user)
+}
+
+// 当前登录用户
+func loginUser(c *gin.Context) (User, bool) {
+	value, _ := Logins.Get(c.Request)
+	user, ok := value.(User)
+	return user, ok
+}
+
+func issueCode(c *gin.Context, req AuthorizeRequest, user User) {
+	code, err := Grants.IssueCode(AuthorizationCode{
+		ClientId:            req.ClientId,
+		RedirectUri:         req.RedirectUri,
+		Scope:               req.Scope,
+		Nonce:               req.Nonce,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		User:                user,
+	})
+	if err != nil {
+		log.Println(err)
+		redirectError(c, req, "server_error", "issue code failed")
+		return
+	}
+
+	params := url.Values{}
+	params.Add("code", code)
+	if len(req.State) > 0 {
+		params.Add("state", req.State)
+	}
+	redirectToClient(c, req.RedirectUri, params)
+}
+
+func hasScope(scope string, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fastwego/dingding"
+	"github.com/fastwego/dingding-demo/tokencache"
+)
+
+type transportFunc func(*http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// 模拟钉钉接口：good-code 为本企业员工 zhangsan，stranger-code 不是本企业员工
+func fakeDingTalk(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sns/getuserinfo_bycode", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		payload := map[string]string{}
+		_ = json.Unmarshal(body, &payload)
+		switch payload["tmp_auth_code"] {
+		case "good-code":
+			_, _ = w.Write([]byte(`{"errcode":0,"user_info":{"unionid":"union-zhangsan"}}`))
+		case "stranger-code":
+			_, _ = w.Write([]byte(`{"errcode":0,"user_info":{"unionid":"union-stranger"}}`))
+		default:
+			_, _ = w.Write([]byte(`{"errcode":40078,"errmsg":"tmp_auth_code not exist"}`))
+		}
+	})
+	mux.HandleFunc("/gettoken", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"errcode":0,"access_token":"access-token","expires_in":7200}`))
+	})
+	mux.HandleFunc("/user/getUseridByUnionid", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("unionid") == "union-zhangsan" {
+			_, _ = w.Write([]byte(`{"errcode":0,"userid":"zhangsan"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"errcode":60121,"errmsg":"user not found"}`))
+	})
+	mux.HandleFunc("/user/get", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"errcode":0,"userid":"zhangsan","name":"张三","orgEmail":"zhangsan@example.com"}`))
+	})
+
+	transport := transportFunc(func(r *http.Request) (*http.Response, error) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Result(), nil
+	})
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = transport
+	t.Cleanup(func() { http.DefaultTransport = defaultTransport })
+
+	cache, err := tokencache.NewFileCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	atm := &dingding.DefaultAccessTokenManager{
+		Id:    "test-app",
+		Name:  "access_token",
+		Cache: cache,
+		GetRefreshRequestFunc: func() *http.Request {
+			req, _ := http.NewRequest(http.MethodGet, dingding.ServerUrl+"/gettoken", nil)
+			return req
+		},
+	}
+	DingClient = dingding.NewClient(atm)
+	DingClient.HTTPClient = &http.Client{Transport: transport}
+}
+
+func authorizeUrl(params url.Values) string {
+	for key, value := range map[string]string{
+		"client_id":     "grafana",
+		"redirect_uri":  grafanaRedirect,
+		"response_type": "code",
+		"scope":         "openid profile email",
+		"state":         "client-state",
+		"nonce":         "client-nonce",
+	} {
+		if _, ok := params[key]; !ok {
+			params.Set(key, value)
+		}
+	}
+	return "/authorize?" + params.Encode()
+}
+
+func get(router http.Handler, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range cookies {
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+	}
+	return serve(router, r)
+}
+
+func location(t *testing.T, w *httptest.ResponseRecorder) *url.URL {
+	t.Helper()
+	if w.Code != http.StatusFound {
+		t.Fatalf("status = %d %s", w.Code, w.Body.String())
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestAuthorizeRefusesToRedirect(t *testing.T) {
+	router := newTestProvider(t)
+
+	cases := map[string]url.Values{
+		"unknown client":            {"client_id": {"unknown"}},
+		"unregistered redirect_uri": {"redirect_uri": {"https://evil.example.com/callback"}},
+		"redirect_uri with suffix":  {"redirect_uri": {grafanaRedirect + "/../evil"}},
+		"redirect_uri with query":   {"redirect_uri": {grafanaRedirect + "?next=https://evil.example.com"}},
+		"redirect_uri of other app": {"redirect_uri": {spaRedirect}},
+		"missing redirect_uri":      {"redirect_uri": {""}},
+	}
+	for name, params := range cases {
+		w := get(router, authorizeUrl(params))
+		if w.Code != http.StatusBadRequest || len(w.Header().Get("Location")) > 0 {
+			t.Errorf("%s: status = %d, location = %q", name, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestAuthorizeRedirectsErrors(t *testing.T) {
+	router := newTestProvider(t)
+
+	cases := []struct {
+		name   string
+		params url.Values
+		error  string
+	}{
+		{"response_type", url.Values{"response_type": {"token"}}, "unsupported_response_type"},
+		{"scope without openid", url.Values{"scope": {"profile"}}, "invalid_scope"},
+		{"code_challenge_method", url.Values{"code_challenge": {"x"}, "code_challenge_method": {"S512"}}, "invalid_request"},
+		{"public client without PKCE", url.Values{"client_id": {"spa"}, "redirect_uri": {spaRedirect}}, "invalid_request"},
+		{"public client with plain PKCE", url.Values{"client_id": {"spa"}, "redirect_uri": {spaRedirect}, "code_challenge": {"x"}}, "invalid_request"},
+	}
+	for _, tc := range cases {
+		u := location(t, get(router, authorizeUrl(tc.params)))
+		redirect := tc.params.Get("redirect_uri")
+		if len(redirect) == 0 {
+			redirect = grafanaRedirect
+		}
+		if got := u.Scheme + "://" + u.Host + u.Path; got != redirect {
+			t.Errorf("%s: redirected to %s", tc.name, got)
+		}
+		if u.Query().Get("error") != tc.error || u.Query().Get("state") != "client-state" {
+			t.Errorf("%s: query = %v", tc.name, u.Query())
+		}
+	}
+}
+
+// 未登录时跳转钉钉扫码，返回 session cookie 与 state
+func startLogin(t *testing.T, router http.Handler, params url.Values, cookies ...*http.Cookie) (*http.Cookie, string) {
+	t.Helper()
+	w := get(router, authorizeUrl(params), cookies...)
+	u := location(t, w)
+	if !strings.HasPrefix(u.String(), dingding.ServerUrl+"/connect/qrconnect?") {
+		t.Fatalf("redirected to %s", u)
+	}
+	if u.Query().Get("appid") != "login-app-id" || u.Query().Get("redirect_uri") != testIssuer+"/login/callback" {
+		t.Fatalf("qrconnect query = %v", u.Query())
+	}
+
+	session := responseCookie(w, "oidcsession")
+	state := u.Query().Get("state")
+	if session == nil || len(state) == 0 {
+		t.Fatalf("session = %v, state = %q", session, state)
+	}
+	return session, state
+}
+
+func TestLoginCallback(t *testing.T) {
+	router := newTestProvider(t)
+	fakeDingTalk(t)
+
+	// 攻击者事先植入的登录 cookie
+	planted := &http.Cookie{Name: "oidclogin", Value: "attacker-chosen-id"}
+
+	session, state := startLogin(t, router, url.Values{}, planted)
+	w := get(router, "/login/callback?code=good-code&state="+url.QueryEscape(state), session, planted)
+	u := location(t, w)
+	if got := u.Scheme + "://" + u.Host + u.Path; got != grafanaRedirect || u.Query().Get("state") != "client-state" {
+		t.Fatalf("redirected to %s", u)
+	}
+
+	// 登录后换发新的 session id，植入的 id 拿不到登录态
+	login := responseCookie(w, "oidclogin")
+	if login == nil || login.Value == planted.Value || !login.HttpOnly {
+		t.Fatalf("login cookie = %+v", login)
+	}
+	if _, ok := Logins.Get(httptest.NewRequest(http.MethodGet, "/", nil)); ok {
+		t.Fatal("logged in without cookie")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(planted)
+	if _, ok := Logins.Get(r); ok {
+		t.Fatal("planted session id is logged in")
+	}
+
+	// 授权码换取 id_token
+	_, resp := postToken(router, "grafana", grafanaSecret, url.Values{"code": {u.Query().Get("code")}, "redirect_uri": {grafanaRedirect}})
+	claims := verifyIdToken(t, router, resp.IdToken)
+	if claims["sub"] != "zhangsan" || claims["nonce"] != "client-nonce" || claims["email"] != "zhangsan@example.com" {
+		t.Fatalf("claims = %v", claims)
+	}
+
+	// state 只能使用一次
+	if w = get(router, "/login/callback?code=good-code&state="+url.QueryEscape(state), session); w.Code != http.StatusForbidden {
+		t.Fatalf("state replay = %d", w.Code)
+	}
+
+	// 已登录时直接签发授权码
+	u = location(t, get(router, authorizeUrl(url.Values{"nonce": {"second-nonce"}}), login))
+	if len(u.Query().Get("code")) == 0 {
+		t.Fatalf("redirected to %s", u)
+	}
+	_, resp = postToken(router, "grafana", grafanaSecret, url.Values{"code": {u.Query().Get("code")}, "redirect_uri": {grafanaRedirect}})
+	if claims = verifyIdToken(t, router, resp.IdToken); claims["nonce"] != "second-nonce" {
+		t.Fatalf("claims = %v", claims)
+	}
+}
+
+func TestLoginCallbackRejects(t *testing.T) {
+	router := newTestProvider(t)
+	fakeDingTalk(t)
+
+	cases := []struct {
+		name   string
+		code   string
+		state  func(string) string
+		status int
+	}{
+		{"wrong state", "good-code", func(s string) string { return s + "x" }, http.StatusForbidden},
+		{"missing state", "good-code", func(string) string { return "" }, http.StatusForbidden},
+		{"invalid code", "bad-code", func(s string) string { return s }, http.StatusBadGateway},
+		{"not in organization", "stranger-code", func(s string) string { return s }, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		session, state := startLogin(t, router, url.Values{})
+		w := get(router, "/login/callback?code="+tc.code+"&state="+url.QueryEscape(tc.state(state)), session)
+		if w.Code != tc.status || responseCookie(w, "oidclogin") != nil {
+			t.Errorf("%s: status = %d, cookies = %v", tc.name, w.Code, w.Result().Cookies())
+		}
+	}
+
+	// 没有进行中的授权请求
+	if w := get(router, "/login/callback?code=good-code&state=x"); w.Code != http.StatusForbidden {
+		t.Errorf("without session: status = %d", w.Code)
+	}
+}
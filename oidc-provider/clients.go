@@ -0,0 +1,107 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// 公开客户端（SPA、移动端）没有 client_secret，必须使用 PKCE S256
+const authMethodNone = "none"
+
+// Client 接入的客户端应用
+type Client struct {
+	ClientId                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret"`
+	Name                    string   `json:"name"`
+	RedirectUris            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+}
+
+// Public 是否公开客户端
+func (c Client) Public() bool {
+	return c.TokenEndpointAuthMethod == authMethodNone
+}
+
+// AllowRedirect redirect_uri 需与登记的完全一致
+func (c Client) AllowRedirect(redirectUri string) bool {
+	for _, uri := range c.RedirectUris {
+		if uri == redirectUri {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientRegistry 客户端登记表，启动时从 json 文件加载
+type ClientRegistry struct {
+	clients map[string]Client
+}
+
+func LoadClientRegistry(path string) (registry *ClientRegistry, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	clients := []Client{}
+	if err = json.Unmarshal(data, &clients); err != nil {
+		return
+	}
+
+	registry = &ClientRegistry{clients: map[string]Client{}}
+	for _, client := range clients {
+		if len(client.ClientId) == 0 || len(client.RedirectUris) == 0 {
+			return nil, fmt.Errorf("client %q without client_id or redirect_uris", client.Name)
+		}
+		switch client.TokenEndpointAuthMethod {
+		case "", "client_secret_basic", "client_secret_post":
+			if len(client.ClientSecret) == 0 {
+				return nil, fmt.Errorf("client %q without client_secret", client.ClientId)
+			}
+		case authMethodNone:
+			if len(client.ClientSecret) > 0 {
+				return nil, fmt.Errorf("public client %q must not have client_secret", client.ClientId)
+			}
+		default:
+			return nil, fmt.Errorf("client %q: unsupported token_endpoint_auth_method %q", client.ClientId, client.TokenEndpointAuthMethod)
+		}
+		registry.clients[client.ClientId] = client
+	}
+	return
+}
+
+func (r *ClientRegistry) Get(clientId string) (Client, bool) {
+	client, ok := r.clients[clientId]
+	return client, ok
+}
+
+// Authenticate 校验 client_secret，公开客户端不能带 client_secret
+func (r *ClientRegistry) Authenticate(clientId, clientSecret string) (Client, bool) {
+	client, ok := r.clients[clientId]
+	if !ok {
+		return client, false
+	}
+	if client.Public() {
+		return client, len(clientSecret) == 0
+	}
+	if len(client.ClientSecret) == 0 {
+		return client, false
+	}
+	return client, subtle.ConstantTimeCompare([]byte(clientSecret), []byte(client.ClientSecret)) == 1
+}
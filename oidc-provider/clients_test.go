@@ -0,0 +1,76 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadClients(t *testing.T, data string) (*ClientRegistry, error) {
+	path := filepath.Join(t.TempDir(), "clients.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadClientRegistry(path)
+}
+
+func TestLoadClientRegistry(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"confidential", `[{"client_id":"a","client_secret":"s","redirect_uris":["https://a/cb"]}]`, true},
+		{"public", `[{"client_id":"a","redirect_uris":["https://a/cb"],"token_endpoint_auth_method":"none"}]`, true},
+		{"confidential without secret", `[{"client_id":"a","redirect_uris":["https://a/cb"]}]`, false},
+		{"public with secret", `[{"client_id":"a","client_secret":"s","redirect_uris":["https://a/cb"],"token_endpoint_auth_method":"none"}]`, false},
+		{"unknown auth method", `[{"client_id":"a","client_secret":"s","redirect_uris":["https://a/cb"],"token_endpoint_auth_method":"private_key_jwt"}]`, false},
+		{"without redirect_uris", `[{"client_id":"a","client_secret":"s"}]`, false},
+	}
+	for _, tc := range cases {
+		if _, err := loadClients(t, tc.data); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	registry, err := loadClients(t, `[
+		{"client_id":"grafana","client_secret":"secret","redirect_uris":["https://grafana/cb"]},
+		{"client_id":"spa","redirect_uris":["https://spa/cb"],"token_endpoint_auth_method":"none"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		clientId, secret string
+		want             bool
+	}{
+		{"grafana", "secret", true},
+		{"grafana", "wrong", false},
+		{"grafana", "", false},
+		{"spa", "", true},
+		{"spa", "anything", false},
+		{"unknown", "", false},
+	}
+	for _, tc := range cases {
+		if _, ok := registry.Authenticate(tc.clientId, tc.secret); ok != tc.want {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", tc.clientId, tc.secret, ok, tc.want)
+		}
+	}
+}
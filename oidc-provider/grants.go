@@ -0,0 +1,136 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+const (
+	codeLifeTime        = time.Minute
+	accessTokenLifeTime = time.Hour
+)
+
+// AuthorizationCode 授权码对应的授权，只能使用一次
+type AuthorizationCode struct {
+	ClientId            string
+	RedirectUri         string
+	Scope               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	User                User
+	ExpiresAt           time.Time
+}
+
+// AccessToken userinfo 使用的访问令牌
+type AccessToken struct {
+	ClientId  string
+	Scope     string
+	User      User
+	ExpiresAt time.Time
+}
+
+// GrantStore 授权码与访问令牌，保存在内存中，重启后需重新登录
+type GrantStore struct {
+	mu     sync.Mutex
+	codes  map[string]AuthorizationCode
+	tokens map[string]AccessToken
+}
+
+func NewGrantStore() *GrantStore {
+	return &GrantStore{codes: map[string]AuthorizationCode{}, tokens: map[string]AccessToken{}}
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// 调用方持有锁
+func (s *GrantStore) purge(now time.Time) {
+	for code, grant := range s.codes {
+		if now.After(grant.ExpiresAt) {
+			delete(s.codes, code)
+		}
+	}
+	for token, grant := range s.tokens {
+		if now.After(grant.ExpiresAt) {
+			delete(s.tokens, token)
+		}
+	}
+}
+
+func (s *GrantStore) IssueCode(grant AuthorizationCode) (code string, err error) {
+	if code, err = randomToken(); err != nil {
+		return
+	}
+	grant.ExpiresAt = time.Now().Add(codeLifeTime)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(time.Now())
+	s.codes[code] = grant
+	return
+}
+
+// RedeemCode 取出并作废授权码；授权码不属于 clientId 时不作废，避免其他客户端用掉
+func (s *GrantStore) RedeemCode(code string, clientId string) (grant AuthorizationCode, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grant, ok = s.codes[code]
+	if !ok || grant.ClientId != clientId {
+		return grant, false
+	}
+	delete(s.codes, code)
+	if time.Now().After(grant.ExpiresAt) {
+		return grant, false
+	}
+	return
+}
+
+func (s *GrantStore) IssueAccessToken(grant AccessToken) (token string, err error) {
+	if token, err = randomToken(); err != nil {
+		return
+	}
+	grant.ExpiresAt = time.Now().Add(accessTokenLifeTime)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(time.Now())
+	s.tokens[token] = grant
+	return
+}
+
+func (s *GrantStore) AccessToken(token string) (grant AccessToken, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grant, ok = s.tokens[token]
+	if ok && time.Now().After(grant.ExpiresAt) {
+		delete(s.tokens, token)
+		return grant, false
+	}
+	return
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRedeemCode(t *testing.T) {
+	grants := NewGrantStore()
+	code, err := grants.IssueCode(AuthorizationCode{ClientId: "grafana", RedirectUri: "https://grafana.example.com/cb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 其他客户端拿到授权码不能用掉它
+	if _, ok := grants.RedeemCode(code, "gitlab"); ok {
+		t.Fatal("code redeemed by another client")
+	}
+	grant, ok := grants.RedeemCode(code, "grafana")
+	if !ok || grant.RedirectUri != "https://grafana.example.com/cb" {
+		t.Fatalf("redeem = %+v, %v", grant, ok)
+	}
+
+	// 只能使用一次
+	if _, ok = grants.RedeemCode(code, "grafana"); ok {
+		t.Fatal("code redeemed twice")
+	}
+}
+
+func TestRedeemCodeExpired(t *testing.T) {
+	grants := NewGrantStore()
+	code, err := grants.IssueCode(AuthorizationCode{ClientId: "grafana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grants.mu.Lock()
+	grant := grants.codes[code]
+	grant.ExpiresAt = time.Now().Add(-time.Second)
+	grants.codes[code] = grant
+	grants.mu.Unlock()
+
+	if _, ok := grants.RedeemCode(code, "grafana"); ok {
+		t.Fatal("expired code redeemed")
+	}
+	if _, ok := grants.codes[code]; ok {
+		t.Fatal("expired code not removed")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+)
+
+// SigningKey 签发 ID Token 的 RSA 私钥
+type SigningKey struct {
+	Kid string
+	key *rsa.PrivateKey
+}
+
+// LoadSigningKey 从 PEM 文件加载私钥，文件不存在时生成
+func LoadSigningKey(path string) (signingKey *SigningKey, err error) {
+	var key *rsa.PrivateKey
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		if err = ioutil.WriteFile(path, data, 0600); err != nil {
+			return
+		}
+	case err != nil:
+		return
+	default:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("invalid signing key pem")
+		}
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return
+		}
+	}
+
+	// kid 由公钥计算，轮换私钥后客户端可据此区分
+	sum := sha256.Sum256(key.PublicKey.N.Bytes())
+	return &SigningKey{Kid: base64.RawURLEncoding.EncodeToString(sum[:8]), key: key}, nil
+}
+
+// Sign RS256 签名的 JWT
+func (k *SigningKey) Sign(claims map[string]interface{}) (token string, err error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": k.Kid,
+	})
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// JWK 公钥
+func (k *SigningKey) JWK() map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": k.Kid,
+		"n":   base64.RawURLEncoding.EncodeToString(k.key.PublicKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.PublicKey.E)).Bytes()),
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fastwego/dingding-demo/loginsession"
+	"github.com/fastwego/dingding-demo/tokencache"
+
+	"github.com/fastwego/dingding"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/memstore"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+var DingClient *dingding.Client
+var DingConfig map[string]string
+var TokenRefresher *tokencache.Refresher
+var TokenAudits *tokencache.AuditLog
+
+var Clients *ClientRegistry
+var Keys *SigningKey
+var Grants *GrantStore
+var Logins *loginsession.Store
+
+// 加载配置，初始化钉钉客户端、客户端登记表、签名密钥与授权存储
+func setup() {
+	// 加载配置文件
+	viper.SetConfigFile(".env")
+	_ = viper.ReadInConfig()
+
+	viper.SetDefault("SigningKeyFile", "signing_key.pem")
+	viper.SetDefault("ClientsFile", "clients.json")
+
+	DingConfig = map[string]string{
+		"Issuer":         strings.TrimRight(viper.GetString("Issuer"), "/"),
+		"AppKey":         viper.GetString("AppKey"),
+		"AppSecret":      viper.GetString("AppSecret"),
+		"LoginAppId":     viper.GetString("LoginAppId"),
+		"LoginAppSecret": viper.GetString("LoginAppSecret"),
+		"SessionSecret":  viper.GetString("SessionSecret"),
+
+		"AdminToken": viper.GetString("AdminToken"),
+	}
+
+	// 钉钉 AccessToken 管理器
+	atm := &dingding.DefaultAccessTokenManager{
+		Id:   DingConfig["AppKey"],
+		Name: "access_token",
+		GetRefreshRequestFunc: func() *http.Request {
+			params := url.Values{}
+			params.Add("appkey", DingConfig["AppKey"])
+			params.Add("appsecret", DingConfig["AppSecret"])
+			req, _ := http.NewRequest(http.MethodGet, dingding.ServerUrl+"/gettoken?"+params.Encode(), nil)
+
+			return req
+		},
+	}
+
+	// 钉钉 客户端
+	DingClient = dingding.NewClient(atm)
+
+	// access_token 缓存、后台刷新与吊销后重试，后端由 TokenCache 配置
+	var err error
+	TokenRefresher, TokenAudits, DingClient.HTTPClient, err = tokencache.Setup(atm)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	Clients, err = LoadClientRegistry(viper.GetString("ClientsFile"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	Keys, err = LoadSigningKey(viper.GetString("SigningKeyFile"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	Grants = NewGrantStore()
+	Logins = loginsession.NewStore("oidclogin", time.Hour, strings.HasPrefix(DingConfig["Issuer"], "https://"))
+}
+
+func routes() *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Logger(), gin.Recovery())
+
+	// Session 保存在服务端，记录进行中的授权请求；登录用户见 Logins
+	gob.Register(AuthorizeRequest{})
+	store := memstore.NewStore([]byte(DingConfig["SessionSecret"]))
+	store.Options(sessions.Options{Path: "/", MaxAge: 3600, HttpOnly: true})
+	router.Use(sessions.Sessions("oidcsession", store))
+
+	router.GET("/.well-known/openid-configuration", Discovery)
+	router.GET("/jwks.json", JWKS)
+	router.GET("/authorize", Authorize)
+	router.GET("/login/callback", LoginCallback)
+	router.POST("/token", Token)
+	router.GET("/userinfo", UserInfo)
+	router.POST("/userinfo", UserInfo)
+
+	// 管理接口：access_token 查看、强制刷新
+	admin := router.Group("/admin", tokencache.AdminAuth(DingConfig["AdminToken"]))
+	tokencache.NewAdmin(TokenRefresher, TokenAudits).RegisterRoutes(admin)
+
+	return router
+}
+
+func main() {
+	setup()
+
+	svr := &http.Server{
+		Addr:    viper.GetString("LISTEN"),
+		Handler: routes(),
+	}
+
+	go func() {
+		err := svr.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+
+	// 过期前后台刷新 access_token
+	refreshCtx, stopRefresh := context.WithCancel(context.Background())
+	defer stopRefresh()
+	go TokenRefresher.Start(refreshCtx)
+
+	quit := make(chan os.Signal)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	timeout := time.Duration(5) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := svr.Shutdown(ctx); err != nil {
+		log.Fatalln(err)
+	}
+}
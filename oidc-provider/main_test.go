@@ -0,0 +1,153 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fastwego/dingding-demo/loginsession"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	testIssuer      = "https://sso.example.com"
+	grafanaRedirect = "https://grafana.example.com/login/generic_oauth"
+	grafanaSecret   = "grafana-secret"
+	spaRedirect     = "https://app.example.com/callback"
+	testClientsJson = `[
+		{"client_id":"grafana","client_secret":"grafana-secret","redirect_uris":["https://grafana.example.com/login/generic_oauth"]},
+		{"client_id":"gitlab","client_secret":"gitlab-secret","redirect_uris":["https://gitlab.example.com/callback"]},
+		{"client_id":"spa","redirect_uris":["https://app.example.com/callback"],"token_endpoint_auth_method":"none"}
+	]`
+)
+
+// 生成 RSA 密钥较慢，所有测试共用一个
+var testKeyOnce sync.Once
+var testKey *SigningKey
+
+// 以测试配置初始化全局状态，返回完整路由
+func newTestProvider(t *testing.T) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	DingConfig = map[string]string{
+		"Issuer":         testIssuer,
+		"LoginAppId":     "login-app-id",
+		"LoginAppSecret": "login-app-secret",
+		"SessionSecret":  "session-secret",
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "clients.json")
+	if err := os.WriteFile(path, []byte(testClientsJson), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if Clients, err = LoadClientRegistry(path); err != nil {
+		t.Fatal(err)
+	}
+
+	testKeyOnce.Do(func() {
+		testKey, err = LoadSigningKey(filepath.Join(dir, "signing_key.pem"))
+	})
+	if err != nil || testKey == nil {
+		t.Fatal("load signing key:", err)
+	}
+	Keys = testKey
+
+	Grants = NewGrantStore()
+	Logins = loginsession.NewStore("oidclogin", time.Hour, false)
+	return routes()
+}
+
+func serve(router http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// 用 /jwks.json 公布的公钥校验 id_token 签名，返回声明
+func verifyIdToken(t *testing.T, router http.Handler, idToken string) map[string]interface{} {
+	t.Helper()
+
+	w := serve(router, httptest.NewRequest(http.MethodGet, "/jwks.json", nil))
+	jwks := struct {
+		Keys []map[string]string `json:"keys"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &jwks); err != nil || len(jwks.Keys) != 1 {
+		t.Fatalf("jwks = %s, %v", w.Body.String(), err)
+	}
+	jwk := jwks.Keys[0]
+
+	n, err := base64.RawURLEncoding.DecodeString(jwk["n"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk["e"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		t.Fatalf("id_token = %q", idToken)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatal("id_token signature:", err)
+	}
+
+	header := map[string]string{}
+	claims := map[string]interface{}{}
+	for i, v := range []interface{}{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if header["alg"] != "RS256" || header["kid"] != jwk["kid"] {
+		t.Fatalf("id_token header = %v, jwk = %v", header, jwk)
+	}
+	return claims
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Discovery OpenID Provider 元数据
+func Discovery(c *gin.Context) {
+	issuer := DingConfig["Issuer"]
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"claims_supported":                      []string{"sub", "name", "preferred_username", "picture", "email", "email_verified", "department"},
+		"code_challenge_methods_supported":      []string{"plain", "S256"},
+	})
+}
+
+// JWKS 签名公钥
+func JWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": []map[string]string{Keys.JWK()}})
+}
+
+func tokenError(c *gin.Context, status int, code string, description string) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// PKCE 校验
+func verifyCodeChallenge(grant AuthorizationCode, verifier string) bool {
+	if len(grant.CodeChallenge) == 0 {
+		return true
+	}
+	if len(verifier) == 0 {
+		return false
+	}
+
+	expected := verifier
+	if grant.CodeChallengeMethod == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(grant.CodeChallenge)) == 1
+}
+
+// Token 令牌端点：授权码换取 access_token 与 id_token
+func Token(c *gin.Context) {
+	if c.PostForm("grant_type") != "authorization_code" {
+		tokenError(c, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	// client_secret_basic、client_secret_post，公开客户端只带 client_id
+	clientId, clientSecret, ok := c.Request.BasicAuth()
+	if !ok {
+		clientId, clientSecret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	client, ok := Clients.Authenticate(clientId, clientSecret)
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="token"`)
+		tokenError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	grant, ok := Grants.RedeemCode(c.PostForm("code"), client.ClientId)
+	if !ok || grant.RedirectUri != c.PostForm("redirect_uri") {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "invalid code or redirect_uri")
+		return
+	}
+	// 公开客户端没有 secret，只能靠 PKCE 证明持有授权码
+	if client.Public() && (len(grant.CodeChallenge) == 0 || grant.CodeChallengeMethod != "S256") {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "public client requires PKCE S256")
+		return
+	}
+	if !verifyCodeChallenge(grant, c.PostForm("code_verifier")) {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "code_verifier mismatch")
+		return
+	}
+
+	accessToken, err := Grants.IssueAccessToken(AccessToken{ClientId: client.ClientId, Scope: grant.Scope, User: grant.User})
+	if err != nil {
+		log.Println(err)
+		tokenError(c, http.StatusInternalServerError, "server_error", "issue access_token failed")
+		return
+	}
+
+	now := time.Now()
+	claims := grant.User.Claims(grant.Scope)
+	claims["iss"] = DingConfig["Issuer"]
+	claims["aud"] = client.ClientId
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(accessTokenLifeTime).Unix()
+	if len(grant.Nonce) > 0 {
+		claims["nonce"] = grant.Nonce
+	}
+	idToken, err := Keys.Sign(claims)
+	if err != nil {
+		log.Println(err)
+		tokenError(c, http.StatusInternalServerError, "server_error", "sign id_token failed")
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int64(accessTokenLifeTime / time.Second),
+		"id_token":     idToken,
+		"scope":        grant.Scope,
+	})
+}
+
+// UserInfo 以 access_token 获取用户声明
+func UserInfo(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	grant, ok := Grants.AccessToken(token)
+	if len(token) == 0 || !ok {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	c.JSON(http.StatusOK, grant.User.Claims(grant.Scope))
+}
@@ -0,0 +1,249 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// RFC 7636 附录 B 示例
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	cases := []struct {
+		name     string
+		grant    AuthorizationCode
+		verifier string
+		want     bool
+	}{
+		{"no challenge", AuthorizationCode{}, "", true},
+		{"S256", AuthorizationCode{CodeChallenge: challenge, CodeChallengeMethod: "S256"}, verifier, true},
+		{"S256 wrong verifier", AuthorizationCode{CodeChallenge: challenge, CodeChallengeMethod: "S256"}, verifier + "x", false},
+		{"S256 missing verifier", AuthorizationCode{CodeChallenge: challenge, CodeChallengeMethod: "S256"}, "", false},
+		// S256 的 challenge 不能直接作为 verifier 使用
+		{"S256 challenge as verifier", AuthorizationCode{CodeChallenge: challenge, CodeChallengeMethod: "S256"}, challenge, false},
+		{"plain", AuthorizationCode{CodeChallenge: verifier, CodeChallengeMethod: "plain"}, verifier, true},
+		{"plain wrong verifier", AuthorizationCode{CodeChallenge: verifier, CodeChallengeMethod: "plain"}, challenge, false},
+	}
+	for _, tc := range cases {
+		if got := verifyCodeChallenge(tc.grant, tc.verifier); got != tc.want {
+			t.Errorf("%s: verifyCodeChallenge = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IdToken     string `json:"id_token"`
+	Error       string `json:"error"`
+}
+
+func issueTestCode(t *testing.T, grant AuthorizationCode) string {
+	if len(grant.Scope) == 0 {
+		grant.Scope = "openid profile"
+	}
+	grant.User = User{Userid: "zhangsan", Name: "张三"}
+	code, err := Grants.IssueCode(grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// 不带 client_id 时用 Basic 认证（client_secret_basic）
+func postToken(router http.Handler, basicId, basicSecret string, form url.Values) (*httptest.ResponseRecorder, tokenResponse) {
+	form.Set("grant_type", "authorization_code")
+	r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(basicId) > 0 {
+		r.SetBasicAuth(basicId, basicSecret)
+	}
+
+	w := serve(router, r)
+	resp := tokenResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func TestTokenClientSecretBasic(t *testing.T) {
+	router := newTestProvider(t)
+	code := issueTestCode(t, AuthorizationCode{ClientId: "grafana", RedirectUri: grafanaRedirect, Nonce: "nonce-1"})
+
+	w, resp := postToken(router, "grafana", grafanaSecret, url.Values{"code": {code}, "redirect_uri": {grafanaRedirect}})
+	if w.Code != http.StatusOK || len(resp.AccessToken) == 0 || len(resp.IdToken) == 0 {
+		t.Fatalf("token = %d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("token response must not be cached")
+	}
+
+	claims := verifyIdToken(t, router, resp.IdToken)
+	if claims["iss"] != testIssuer || claims["aud"] != "grafana" || claims["sub"] != "zhangsan" || claims["nonce"] != "nonce-1" {
+		t.Fatalf("claims = %v", claims)
+	}
+	iat, _ := claims["iat"].(float64)
+	exp, _ := claims["exp"].(float64)
+	if exp-iat != accessTokenLifeTime.Seconds() || time.Unix(int64(exp), 0).Before(time.Now()) {
+		t.Fatalf("iat = %v, exp = %v", iat, exp)
+	}
+}
+
+func TestTokenClientSecretPost(t *testing.T) {
+	router := newTestProvider(t)
+	code := issueTestCode(t, AuthorizationCode{ClientId: "grafana", RedirectUri: grafanaRedirect})
+
+	w, resp := postToken(router, "", "", url.Values{
+		"code":          {code},
+		"redirect_uri":  {grafanaRedirect},
+		"client_id":     {"grafana"},
+		"client_secret": {grafanaSecret},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("token = %d %s", w.Code, w.Body.String())
+	}
+
+	// 没有 nonce 时 id_token 中不带 nonce
+	if claims := verifyIdToken(t, router, resp.IdToken); claims["nonce"] != nil {
+		t.Fatalf("claims = %v", claims)
+	}
+}
+
+func TestTokenClientAuthentication(t *testing.T) {
+	router := newTestProvider(t)
+	code := issueTestCode(t, AuthorizationCode{ClientId: "grafana", RedirectUri: grafanaRedirect})
+	form := func() url.Values {
+		return url.Values{"code": {code}, "redirect_uri": {grafanaRedirect}}
+	}
+
+	for _, secret := range []string{"wrong", ""} {
+		w, resp := postToken(router, "grafana", secret, form())
+		if w.Code != http.StatusUnauthorized || resp.Error != "invalid_client" || len(w.Header().Get("WWW-Authenticate")) == 0 {
+			t.Fatalf("secret %q: token = %d %s", secret, w.Code, w.Body.String())
+		}
+	}
+	if w, _ := postToken(router, "unknown", "secret", form()); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown client: token = %d", w.Code)
+	}
+
+	// 认证失败不会用掉授权码
+	if w, _ := postToken(router, "grafana", grafanaSecret, form()); w.Code != http.StatusOK {
+		t.Fatalf("token = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTokenRedirectUriExactMatch(t *testing.T) {
+	router := newTestProvider(t)
+
+	for _, redirectUri := range []string{"", grafanaRedirect + "/", grafanaRedirect + "?next=/", strings.ToUpper(grafanaRedirect)} {
+		code := issueTestCode(t, AuthorizationCode{ClientId: "grafana", RedirectUri: grafanaRedirect})
+		w, resp := postToken(router, "grafana", grafanaSecret, url.Values{"code": {code}, "redirect_uri": {redirectUri}})
+		if w.Code != http.StatusBadRequest || resp.Error != "invalid_grant" {
+			t.Fatalf("redirect_uri %q: token = %d %s", redirectUri, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestTokenCodeSingleUse(t *testing.T) {
+	router := newTestProvider(t)
+	code := issueTestCode(t, AuthorizationCode{ClientId: "grafana", RedirectUri: grafanaRedirect})
+	form := url.Values{"code": {code}, "redirect_uri": {grafanaRedirect}}
+
+	if w, _ := postToken(router, "grafana", grafanaSecret, form); w.Code != http.StatusOK {
+		t.Fatalf("first redeem = %d %s", w.Code, w.Body.String())
+	}
+	if w, resp := postToken(router, "grafana", grafanaSecret, form); w.Code != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		t.Fatalf("second redeem = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTokenCodeExpired(t *testing.T) {
+	router := newTestProvider(t)
+	code := issueTestCode(t, AuthorizationCode{ClientId: "grafana", RedirectUri: grafanaRedirect})
+
+	Grants.mu.Lock()
+	grant := Grants.codes[code]
+	grant.ExpiresAt = time.Now().Add(-time.Second)
+	Grants.codes[code] = grant
+	Grants.mu.Unlock()
+
+	w, resp := postToken(router, "grafana", grafanaSecret, url.Values{"code": {code}, "redirect_uri": {grafanaRedirect}})
+	if w.Code != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		t.Fatalf("token = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTokenCodeOfAnotherClient(t *testing.T) {
+	router := newTestProvider(t)
+	code := issueTestCode(t, AuthorizationCode{ClientId: "grafana", RedirectUri: grafanaRedirect})
+	form := url.Values{"code": {code}, "redirect_uri": {grafanaRedirect}}
+
+	if w, resp := postToken(router, "gitlab", "gitlab-secret", form); w.Code != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		t.Fatalf("gitlab redeem = %d %s", w.Code, w.Body.String())
+	}
+
+	// 其他客户端尝试后，授权码仍归原客户端
+	if w, _ := postToken(router, "grafana", grafanaSecret, form); w.Code != http.StatusOK {
+		t.Fatalf("grafana redeem = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTokenPublicClient(t *testing.T) {
+	router := newTestProvider(t)
+
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	newCode := func(grant AuthorizationCode) url.Values {
+		grant.ClientId, grant.RedirectUri = "spa", spaRedirect
+		return url.Values{"code": {issueTestCode(t, grant)}, "redirect_uri": {spaRedirect}, "client_id": {"spa"}}
+	}
+
+	form := newCode(AuthorizationCode{CodeChallenge: challenge, CodeChallengeMethod: "S256"})
+	form.Set("code_verifier", verifier)
+	if w, resp := postToken(router, "", "", form); w.Code != http.StatusOK || verifyIdToken(t, router, resp.IdToken)["aud"] != "spa" {
+		t.Fatalf("public client = %d %s", w.Code, w.Body.String())
+	}
+
+	// 公开客户端不能带 secret
+	form = newCode(AuthorizationCode{CodeChallenge: challenge, CodeChallengeMethod: "S256"})
+	form.Set("code_verifier", verifier)
+	if w, _ := postToken(router, "spa", "secret", form); w.Code != http.StatusUnauthorized {
+		t.Fatalf("public client with secret = %d", w.Code)
+	}
+
+	// 缺少或错误的 code_verifier
+	form = newCode(AuthorizationCode{CodeChallenge: challenge, CodeChallengeMethod: "S256"})
+	if w, resp := postToken(router, "", "", form); w.Code != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		t.Fatalf("missing verifier = %d %s", w.Code, w.Body.String())
+	}
+
+	// 没有 PKCE S256 的授权码不能由公开客户端兑换
+	for _, grant := range []AuthorizationCode{{}, {CodeChallenge: verifier, CodeChallengeMethod: "plain"}} {
+		form = newCode(grant)
+		form.Set("code_verifier", verifier)
+		if w, resp := postToken(router, "", "", form); w.Code != http.StatusBadRequest || resp.Error != "invalid_grant" {
+			t.Fatalf("%+v: token = %d %s", grant, w.Code, w.Body.String())
+		}
+	}
+}
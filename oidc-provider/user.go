@@ -0,0 +1,157 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fastwego/dingding"
+	"github.com/fastwego/dingding/util"
+)
+
+// User 登录的员工，字段来自 /user/get
+type User struct {
+	Userid     string  `json:"userid"`
+	Unionid    string  `json:"unionid"`
+	Name       string  `json:"name"`
+	Avatar     string  `json:"avatar"`
+	Email      string  `json:"email"`
+	OrgEmail   string  `json:"orgEmail"`
+	Department []int64 `json:"department"`
+}
+
+// Claims 按 scope 输出的用户声明
+func (u User) Claims(scope string) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": u.Userid,
+	}
+
+	for _, s := range strings.Fields(scope) {
+		switch s {
+		case "profile":
+			claims["name"] = u.Name
+			claims["preferred_username"] = u.Userid
+			claims["picture"] = u.Avatar
+			claims["department"] = u.Department
+		case "email":
+			// 优先使用企业邮箱
+			email := u.OrgEmail
+			if len(email) == 0 {
+				email = u.Email
+			}
+			if len(email) > 0 {
+				claims["email"] = email
+				claims["email_verified"] = len(u.OrgEmail) > 0
+			}
+		}
+	}
+	return claims
+}
+
+// 扫码登录的 code 换取 unionid
+// 签名：HmacSHA256(timestamp, LoginAppSecret)
+func unionidByCode(code string) (unionid string, err error) {
+	timestamp := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	params := url.Values{}
+	params.Add("accessKey", DingConfig["LoginAppId"])
+	params.Add("timestamp", timestamp)
+	params.Add("signature", util.Signature(timestamp, DingConfig["LoginAppSecret"]))
+
+	payload, err := json.Marshal(map[string]string{
+		"tmp_auth_code": code,
+	})
+	if err != nil {
+		return
+	}
+
+	resp, err := http.Post(dingding.ServerUrl+"/sns/getuserinfo_bycode?"+params.Encode(), "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	result := struct {
+		Errcode  int    `json:"errcode"`
+		Errmsg   string `json:"errmsg"`
+		UserInfo struct {
+			Unionid string `json:"unionid"`
+		} `json:"user_info"`
+	}{}
+	if err = json.Unmarshal(body, &result); err != nil {
+		return
+	}
+	if result.Errcode != 0 {
+		return "", fmt.Errorf("getuserinfo_bycode: %d %s", result.Errcode, result.Errmsg)
+	}
+	return result.UserInfo.Unionid, nil
+}
+
+// 通过 unionid 查询企业内的员工
+func userByUnionid(unionid string) (user User, err error) {
+	params := url.Values{}
+	params.Add("unionid", unionid)
+
+	req, _ := http.NewRequest(http.MethodGet, "/user/getUseridByUnionid?"+params.Encode(), nil)
+	resp, err := DingClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	result := struct {
+		Errcode int    `json:"errcode"`
+		Errmsg  string `json:"errmsg"`
+		Userid  string `json:"userid"`
+	}{}
+	if err = json.Unmarshal(resp, &result); err != nil {
+		return
+	}
+	if result.Errcode != 0 || len(result.Userid) == 0 {
+		return user, fmt.Errorf("getUseridByUnionid: %d %s", result.Errcode, result.Errmsg)
+	}
+
+	params = url.Values{}
+	params.Add("userid", result.Userid)
+	req, _ = http.NewRequest(http.MethodGet, "/user/get?"+params.Encode(), nil)
+	resp, err = DingClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	detail := struct {
+		Errcode int    `json:"errcode"`
+		Errmsg  string `json:"errmsg"`
+		User
+	}{}
+	if err = json.Unmarshal(resp, &detail); err != nil {
+		return
+	}
+	if detail.Errcode != 0 || len(detail.Userid) == 0 {
+		return user, fmt.Errorf("user/get: %d %s", detail.Errcode, detail.Errmsg)
+	}
+	return detail.User, nil
+}
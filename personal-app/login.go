@@ -0,0 +1,202 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/fastwego/dingding"
+	"github.com/fastwego/dingding/util"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// SnsUser 扫码登录的钉钉用户
+type SnsUser struct {
+	Nick    string `json:"nick"`
+	Unionid string `json:"unionid"`
+	Openid  string `json:"openid"`
+}
+
+// 随机 state，防止 CSRF
+func newState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Login 跳转到钉钉扫码登录页
+func Login(c *gin.Context) {
+	state, err := newState()
+	if err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	session := sessions.Default(c)
+	session.Set("state", state)
+	if err = session.Save(); err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, qrconnectUrl(state, DingConfig["RedirectUri"]))
+}
+
+// 钉钉扫码页，扫码后带 code 与 state 回跳 redirectUri
+func qrconnectUrl(state string, redirectUri string) string {
+	params := url.Values{}
+	params.Add("appid", DingConfig["AppId"])
+	params.Add("response_type", "code")
+	params.Add("scope", "snsapi_login")
+	params.Add("state", state)
+	params.Add("redirect_uri", redirectUri)
+
+	return dingding.ServerUrl + "/connect/qrconnect?" + params.Encode()
+}
+
+// 取出并作废 session 中的 state，与回跳带回的 state 比较
+func verifyState(session sessions.Session, key string, state string) bool {
+	expected, _ := session.Get(key).(string)
+	session.Delete(key)
+	return len(expected) > 0 && subtle.ConstantTimeCompare([]byte(state), []byte(expected)) == 1
+}
+
+// LoginCallback 扫码后钉钉回跳：校验 state，用 code 换取用户身份并登录
+func LoginCallback(c *gin.Context) {
+	session := sessions.Default(c)
+
+	// state 仅可使用一次
+	if !verifyState(session, "state", c.Query("state")) {
+		_ = session.Save()
+		c.String(http.StatusForbidden, "invalid state")
+		return
+	}
+
+	code := c.Query("code")
+	if len(code) == 0 {
+		_ = session.Save()
+		c.String(http.StatusBadRequest, "missing code")
+		return
+	}
+
+	user, err := getUserInfoByCode(code)
+	if err != nil {
+		log.Println(err)
+		_ = session.Save()
+		c.String(http.StatusBadGateway, "login failed")
+		return
+	}
+
+	if err = session.Save(); err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	// 登录成功换发新的 session id
+	if err = Logins.Login(c.Writer, c.Request, user); err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/me")
+}
+
+// 当前登录用户
+func sessionUser(c *gin.Context) (SnsUser, bool) {
+	value, _ := Logins.Get(c.Request)
+	user, ok := value.(SnsUser)
+	return user, ok && len(user.Openid) > 0
+}
+
+// Me 当前登录用户
+func Me(c *gin.Context) {
+	user, ok := sessionUser(c)
+	if !ok {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// Logout 退出登录，只接受 POST，避免第三方页面用 <img src="/logout"> 等 GET 请求让用户退出
+func Logout(c *gin.Context) {
+	Logins.Logout(c.Writer, c.Request)
+
+	session := sessions.Default(c)
+	session.Clear()
+	if err := session.Save(); err != nil {
+		log.Println(err)
+	}
+	c.Redirect(http.StatusSeeOther, "/login")
+}
+
+// 用扫码返回的临时授权码获取用户信息
+// 签名：HmacSHA256(timestamp, AppSecret)，无需 access_token
+func getUserInfoByCode(code string) (user SnsUser, err error) {
+	timestamp := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	params := url.Values{}
+	params.Add("accessKey", DingConfig["AppId"])
+	params.Add("timestamp", timestamp)
+	params.Add("signature", util.Signature(timestamp, DingConfig["AppSecret"]))
+
+	payload, err := json.Marshal(map[string]string{
+		"tmp_auth_code": code,
+	})
+	if err != nil {
+		return
+	}
+
+	resp, err := http.Post(dingding.ServerUrl+"/sns/getuserinfo_bycode?"+params.Encode(), "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	result := struct {
+		Errcode  int     `json:"errcode"`
+		Errmsg   string  `json:"errmsg"`
+		UserInfo SnsUser `json:"user_info"`
+	}{}
+	if err = json.Unmarshal(body, &result); err != nil {
+		return
+	}
+	if result.Errcode != 0 {
+		return user, fmt.Errorf("getuserinfo_bycode: %d %s", result.Errcode, result.Errmsg)
+	}
+
+	return result.UserInfo, nil
+}
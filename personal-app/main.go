@@ -21,33 +21,49 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/faabiosr/cachego/file"
+	"github.com/fastwego/dingding-demo/loginsession"
+	"github.com/fastwego/dingding-demo/tokencache"
 
 	"github.com/fastwego/dingding"
 
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/memstore"
+
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
 )
 
 var DingClient *dingding.Client
 var DingConfig map[string]string
+var TokenRefresher *tokencache.Refresher
+var TokenAudits *tokencache.AuditLog
+var SnsUserTokens *SnsTokens
+var Logins *loginsession.Store
 
 func init() {
 	// 加载配置文件
 	viper.SetConfigFile(".env")
 	_ = viper.ReadInConfig()
 
+	viper.SetDefault("PersistentCodeFile", "persistent_codes.json")
+
 	DingConfig = map[string]string{
-		"AppId":     viper.GetString("AppId"),
-		"AppSecret": viper.GetString("AppSecret"),
+		"AppId":          viper.GetString("AppId"),
+		"AppSecret":      viper.GetString("AppSecret"),
+		"RedirectUri":    viper.GetString("RedirectUri"),
+		"SnsRedirectUri": viper.GetString("SnsRedirectUri"),
+		"SessionSecret":  viper.GetString("SessionSecret"),
+
+		"AdminToken": viper.GetString("AdminToken"),
 	}
 
 	// 钉钉 AccessToken 管理器
 	atm := &dingding.DefaultAccessTokenManager{
-		Id:   DingConfig["AppKey"],
+		Id:   DingConfig["AppId"],
 		Name: "access_token",
 		GetRefreshRequestFunc: func() *http.Request {
 			params := url.Values{}
@@ -57,31 +73,51 @@ func init() {
 			req, _ := http.NewRequest(http.MethodGet, dingding.ServerUrl+"/sns/gettoken?"+params.Encode(), nil)
 			return req
 		},
-		Cache: file.New(os.TempDir()),
 	}
 
 	// 钉钉 客户端
 	DingClient = dingding.NewClient(atm)
 
+	// access_token 缓存、后台刷新与吊销后重试，后端由 TokenCache 配置
+	var err error
+	TokenRefresher, TokenAudits, DingClient.HTTPClient, err = tokencache.Setup(atm)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// 登录态，登录成功后换发新的 session id
+	Logins = loginsession.NewStore("gologin", 24*time.Hour, strings.HasPrefix(DingConfig["RedirectUri"], "https://"))
+
+	// 用户的持久授权码与 sns_token
+	SnsUserTokens, err = NewSnsTokens(viper.GetString("PersistentCodeFile"), TokenRefresher.Cache)
+	if err != nil {
+		log.Fatalln(err)
+	}
 }
 func main() {
 
 	router := gin.New()
 	router.Use(gin.Logger(), gin.Recovery())
 
-	// 调用接口
-	router.GET("/sns/get_persistent_code", func(c *gin.Context) {
-		params := url.Values{}
-		params.Add("tmp_auth_code", "13800138000")
+	// Session 保存在服务端，cookie 中只有 session id，用于登录前的 state；登录用户见 Logins
+	store := memstore.NewStore([]byte(DingConfig["SessionSecret"]))
+	store.Options(sessions.Options{Path: "/", MaxAge: 86400, HttpOnly: true})
+	router.Use(sessions.Sessions("gosession", store))
 
-		req, _ := http.NewRequest(http.MethodGet, "/sns/get_persistent_code?"+params.Encode(), nil)
-		get, err := DingClient.Do(req)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		log.Println(string(get))
-	})
+	// 扫码登录
+	router.GET("/login", Login)
+	router.GET("/login/callback", LoginCallback)
+	router.POST("/logout", Logout)
+	router.GET("/me", Me)
+
+	// 持久授权码与 sns_token 仅限当前登录用户本人
+	router.GET("/sns/authorize", SnsAuthorize)
+	router.GET("/sns/callback", SnsCallback)
+	router.GET("/sns/getuserinfo", SnsUserInfo)
+
+	// 管理接口：access_token 查看、强制刷新
+	admin := router.Group("/admin", tokencache.AdminAuth(DingConfig["AdminToken"]))
+	tokencache.NewAdmin(TokenRefresher, TokenAudits).RegisterRoutes(admin)
 
 	svr := &http.Server{
 		Addr:    viper.GetString("LISTEN"),
@@ -95,6 +131,11 @@ func main() {
 		}
 	}()
 
+	// 过期前后台刷新 access_token
+	refreshCtx, stopRefresh := context.WithCancel(context.Background())
+	defer stopRefresh()
+	go TokenRefresher.Start(refreshCtx)
+
 	quit := make(chan os.Signal)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -0,0 +1,319 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/faabiosr/cachego"
+	"github.com/fastwego/dingding"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrNoPersistentCode 用户未授权
+var ErrNoPersistentCode = errors.New("persistent code not found")
+
+// ErrOpenidMismatch 临时授权码不属于当前登录用户
+var ErrOpenidMismatch = errors.New("tmp_auth_code belongs to another user")
+
+// PersistentCode 用户授权后获得的持久授权码
+type PersistentCode struct {
+	Openid         string    `json:"openid"`
+	Unionid        string    `json:"unionid"`
+	PersistentCode string    `json:"persistent_code"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// SnsTokens 按用户管理 persistent_code 与 sns_token
+type SnsTokens struct {
+	path  string
+	cache cachego.Cache
+
+	mu       sync.Mutex
+	codes    map[string]PersistentCode // openid
+	managers map[string]*SnsTokenManager
+}
+
+func NewSnsTokens(path string, cache cachego.Cache) (tokens *SnsTokens, err error) {
+	tokens = &SnsTokens{
+		path:     path,
+		cache:    cache,
+		codes:    map[string]PersistentCode{},
+		managers: map[string]*SnsTokenManager{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &tokens.codes)
+	return
+}
+
+// Exchange 用临时授权码换取持久授权码并保存，授权码须属于 openid 对应的用户
+func (t *SnsTokens) Exchange(tmpAuthCode string, openid string) (code PersistentCode, err error) {
+	payload, err := json.Marshal(map[string]string{
+		"tmp_auth_code": tmpAuthCode,
+	})
+	if err != nil {
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/sns/get_persistent_code", bytes.NewReader(payload))
+	resp, err := DingClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	result := struct {
+		Errcode int    `json:"errcode"`
+		Errmsg  string `json:"errmsg"`
+		PersistentCode
+	}{}
+	if err = json.Unmarshal(resp, &result); err != nil {
+		return
+	}
+	if result.Errcode != 0 || len(result.Openid) == 0 {
+		return code, fmt.Errorf("get_persistent_code: %d %s", result.Errcode, result.Errmsg)
+	}
+	if result.Openid != openid {
+		return code, ErrOpenidMismatch
+	}
+	code = result.PersistentCode
+	code.UpdatedAt = time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.codes[code.Openid] = code
+	if err = t.flush(); err != nil {
+		return
+	}
+
+	// 重新授权后旧的 sns_token 作废；其他副本或重启前缓存的同样在共享缓存中，直接按 key 删除
+	err = t.cache.Delete(snsTokenCacheKey(code.Openid))
+	return
+}
+
+// 调用方持有锁
+func (t *SnsTokens) flush() (err error) {
+	data, err := json.Marshal(t.codes)
+	if err != nil {
+		return
+	}
+
+	// 持久授权码长期有效，仅当前用户可读
+	tmp := t.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// ClientFor 以用户 sns_token 调用接口的客户端，如 /sns/getuserinfo
+func (t *SnsTokens) ClientFor(openid string) (*dingding.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.codes[openid]; !ok {
+		return nil, ErrNoPersistentCode
+	}
+
+	m, ok := t.managers[openid]
+	if !ok {
+		m = &SnsTokenManager{Openid: openid, tokens: t}
+		t.managers[openid] = m
+	}
+	return dingding.NewClient(m), nil
+}
+
+func (t *SnsTokens) persistentCode(openid string) (PersistentCode, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	code, ok := t.codes[openid]
+	return code, ok
+}
+
+// SnsTokenManager 单个用户的 sns_token，过期后用持久授权码重新获取
+type SnsTokenManager struct {
+	Openid string
+
+	tokens *SnsTokens
+	mu     sync.Mutex
+}
+
+// 按 AppId 与用户区分，避免不同应用、不同用户互相覆盖
+func snsTokenCacheKey(openid string) string {
+	return "sns_token:" + DingConfig["AppId"] + ":" + openid
+}
+
+func (m *SnsTokenManager) cacheKey() string {
+	return snsTokenCacheKey(m.Openid)
+}
+
+func (m *SnsTokenManager) GetName() string {
+	return "sns_token"
+}
+
+func (m *SnsTokenManager) GetAccessToken() (snsToken string, err error) {
+	// 同一用户并发请求只刷新一次
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snsToken, err = m.tokens.cache.Fetch(m.cacheKey())
+	if err == nil && len(snsToken) > 0 {
+		return
+	}
+
+	code, ok := m.tokens.persistentCode(m.Openid)
+	if !ok {
+		return "", ErrNoPersistentCode
+	}
+
+	payload, err := json.Marshal(map[string]string{
+		"openid":          code.Openid,
+		"persistent_code": code.PersistentCode,
+	})
+	if err != nil {
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/sns/get_sns_token", bytes.NewReader(payload))
+	resp, err := DingClient.Do(req)
+	if err != nil {
+		return
+	}
+
+	result := struct {
+		Errcode   int    `json:"errcode"`
+		Errmsg    string `json:"errmsg"`
+		SnsToken  string `json:"sns_token"`
+		ExpiresIn int64  `json:"expires_in"`
+	}{}
+	if err = json.Unmarshal(resp, &result); err != nil {
+		return
+	}
+	if result.Errcode != 0 || len(result.SnsToken) == 0 {
+		return "", fmt.Errorf("get_sns_token: %d %s", result.Errcode, result.Errmsg)
+	}
+
+	// 提前一分钟过期，避免使用临界的 sns_token
+	lifeTime := time.Duration(result.ExpiresIn)*time.Second - time.Minute
+	if lifeTime <= 0 {
+		lifeTime = time.Duration(result.ExpiresIn) * time.Second
+	}
+	if err = m.tokens.cache.Save(m.cacheKey(), result.SnsToken, lifeTime); err != nil {
+		return
+	}
+	return result.SnsToken, nil
+}
+
+// SnsAuthorize 当前登录用户再次扫码授权，回跳 SnsRedirectUri 换取持久授权码
+// 登录时的 code 已被 getuserinfo_bycode 使用，不能再换取持久授权码
+func SnsAuthorize(c *gin.Context) {
+	if _, ok := sessionUser(c); !ok {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	state, err := newState()
+	if err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	session := sessions.Default(c)
+	session.Set("sns_state", state)
+	if err = session.Save(); err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, qrconnectUrl(state, DingConfig["SnsRedirectUri"]))
+}
+
+// SnsCallback 授权扫码后钉钉回跳：校验 state，用 code 为当前登录用户换取持久授权码
+func SnsCallback(c *gin.Context) {
+	user, ok := sessionUser(c)
+	if !ok {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	// state 仅可使用一次
+	session := sessions.Default(c)
+	if !verifyState(session, "sns_state", c.Query("state")) {
+		_ = session.Save()
+		c.String(http.StatusForbidden, "invalid state")
+		return
+	}
+	if err := session.Save(); err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	code, err := SnsUserTokens.Exchange(c.Query("code"), user.Openid)
+	if err == ErrOpenidMismatch {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"openid": code.Openid, "unionid": code.Unionid})
+}
+
+// SnsUserInfo 以当前登录用户的 sns_token 获取用户信息
+func SnsUserInfo(c *gin.Context) {
+	user, ok := sessionUser(c)
+	if !ok {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	client, err := SnsUserTokens.ClientFor(user.Openid)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/sns/getuserinfo", nil)
+	get, err := client.Do(req)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "application/json", get)
+}
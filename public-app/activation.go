@@ -0,0 +1,156 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 接口返回的 errcode，Do 只返回响应内容，非 0 时需自行处理
+func checkErrcode(api string, resp []byte) error {
+	result := struct {
+		Errcode int    `json:"errcode"`
+		Errmsg  string `json:"errmsg"`
+	}{}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return fmt.Errorf("%s: %w", api, err)
+	}
+	if result.Errcode != 0 {
+		return fmt.Errorf("%s: %d %s", api, result.Errcode, result.Errmsg)
+	}
+	return nil
+}
+
+// AuthorizeTenant 用临时授权码换取永久授权码，保存授权企业
+func AuthorizeTenant(tmpAuthCode string) (tenant Tenant, err error) {
+	payload, err := json.Marshal(map[string]string{
+		"tmp_auth_code": tmpAuthCode,
+	})
+	if err != nil {
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/service/get_permanent_code", bytes.NewReader(payload))
+	resp, err := DingClientSuite.Do(req)
+	if err != nil {
+		return
+	}
+	if err = checkErrcode("get_permanent_code", resp); err != nil {
+		return
+	}
+
+	result := struct {
+		PermanentCode string `json:"permanent_code"`
+		AuthCorpInfo  struct {
+			Corpid   string `json:"corpid"`
+			CorpName string `json:"corp_name"`
+		} `json:"auth_corp_info"`
+	}{}
+	if err = json.Unmarshal(resp, &result); err != nil {
+		return
+	}
+	if len(result.AuthCorpInfo.Corpid) == 0 || len(result.PermanentCode) == 0 {
+		return tenant, fmt.Errorf("get_permanent_code: no corpid or permanent_code in %s", resp)
+	}
+
+	tenant, err = Tenants.Tenant(result.AuthCorpInfo.Corpid)
+	if err != nil && err != ErrTenantNotFound {
+		return
+	}
+	from := tenant.Status
+	tenant.CorpId = result.AuthCorpInfo.Corpid
+	tenant.CorpName = result.AuthCorpInfo.CorpName
+	tenant.PermanentCode = result.PermanentCode
+	tenant.Status = TenantAuthorized
+	tenant.AuthorizedAt = time.Now()
+
+	if err = Tenants.SaveTenant(tenant); err != nil {
+		return
+	}
+
+	// 重新授权时旧的 access_token 不再可用
+	CorpDingClients.Evict(tenant.CorpId)
+
+	err = Tenants.AddAudit(TenantAudit{
+		CorpId:     tenant.CorpId,
+		EventType:  "tmp_auth_code",
+		FromStatus: from,
+		ToStatus:   tenant.Status,
+		CreatedAt:  time.Now(),
+	})
+	return
+}
+
+// ActivateTenant 激活授权企业的应用，每次尝试都会记录
+func ActivateTenant(corpId string) (err error) {
+	tenant, err := Tenants.Tenant(corpId)
+	if err != nil {
+		return
+	}
+	if tenant.Status == TenantRemoved {
+		return ErrTenantInactive
+	}
+
+	payload, err := json.Marshal(map[string]string{
+		"suite_key":      DingConfig["SuiteKey"],
+		"auth_corpid":    tenant.CorpId,
+		"permanent_code": tenant.PermanentCode,
+	})
+	if err != nil {
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/service/activate_suite", bytes.NewReader(payload))
+	resp, err := DingClientSuite.Do(req)
+	if err == nil {
+		err = checkErrcode("activate_suite", resp)
+	}
+
+	activation := Activation{CorpId: corpId, Success: err == nil, CreatedAt: time.Now()}
+	if err != nil {
+		activation.Error = err.Error()
+	}
+	if recordErr := Tenants.AddActivation(activation); recordErr != nil {
+		log.Println(recordErr)
+	}
+	if err != nil {
+		return
+	}
+
+	tenant.Status = TenantActive
+	if err := refreshTenantInfo(&tenant); err != nil {
+		log.Printf("refresh %s failed: %s", corpId, err)
+	}
+	return Tenants.SaveTenant(tenant)
+}
+
+// 授权：由 AuthCodeQueue 在推送响应后调用
+func onTmpAuthCode(tmpAuthCode string) (err error) {
+	tenant, err := AuthorizeTenant(tmpAuthCode)
+	if err != nil {
+		return
+	}
+
+	// 激活失败已记录，可通过管理接口重试，不影响永久授权码的保存
+	if err := ActivateTenant(tenant.CorpId); err != nil {
+		log.Printf("activate %s failed: %s", tenant.CorpId, err)
+	}
+	return nil
+}
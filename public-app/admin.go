@@ -0,0 +1,151 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fastwego/dingding-demo/tokencache"
+	"github.com/gin-gonic/gin"
+)
+
+func adminError(c *gin.Context, err error) {
+	if err == ErrTenantNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err == ErrTenantInactive {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// 激活记录
+func AdminActivations(c *gin.Context) {
+	activations, err := Tenants.Activations(c.Query("corpid"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, activations)
+}
+
+// 重新激活
+func AdminActivateTenant(c *gin.Context) {
+	err := ActivateTenant(c.Param("corpid"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"corpid": c.Param("corpid"), "status": TenantActive})
+}
+
+// 授权变更记录
+func AdminTenantAudits(c *gin.Context) {
+	audits, err := Tenants.Audits(c.Query("corpid"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, audits)
+}
+
+// 管理接口中的企业信息，不输出永久授权码
+type tenantView struct {
+	Tenant
+	PermanentCode  string     `json:"permanent_code,omitempty"`
+	TokenExpiresAt *time.Time `json:"token_expires_at"`
+}
+
+func newTenantView(tenant Tenant) tenantView {
+	view := tenantView{Tenant: tenant}
+	if expiresAt := CorpDingClients.TokenExpiry(tenant.CorpId); !expiresAt.IsZero() {
+		view.TokenExpiresAt = &expiresAt
+	}
+	return view
+}
+
+// 授权企业列表
+func AdminTenants(c *gin.Context) {
+	tenants, err := Tenants.Tenants()
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	views := make([]tenantView, 0, len(tenants))
+	for _, tenant := range tenants {
+		views = append(views, newTenantView(tenant))
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+// 授权企业详情
+func AdminTenant(c *gin.Context) {
+	tenant, err := Tenants.Tenant(c.Param("corpid"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newTenantView(tenant))
+}
+
+// 强制刷新企业 access_token
+func AdminRefreshTenantToken(c *gin.Context) {
+	expiresAt, err := CorpDingClients.Refresh(c.Param("corpid"))
+
+	audit := tokencache.TokenAudit{
+		Name:     "access_token",
+		Id:       corpManagerId(c.Param("corpid")),
+		Operator: c.ClientIP(),
+		Reason:   c.Query("reason"),
+	}
+	if err != nil {
+		audit.Error = err.Error()
+	} else if !expiresAt.IsZero() {
+		audit.ExpiresAt = &expiresAt
+	}
+	if auditErr := TokenAudits.Append(audit); auditErr != nil {
+		log.Println(auditErr)
+	}
+
+	if err == tokencache.ErrRefreshInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"corpid": c.Param("corpid"), "token_expires_at": expiresAt})
+}
+
+// 企业的订单与已购版本
+func AdminTenantOrders(c *gin.Context) {
+	orders, err := Tenants.Orders(c.Param("corpid"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	entitlements, err := Tenants.Entitlements(c.Param("corpid"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"orders": orders, "entitlements": entitlements})
+}
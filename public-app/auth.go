@@ -0,0 +1,109 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CorpUser 授权企业中免登的员工
+type CorpUser struct {
+	CorpId string `json:"corpid"`
+	Userid string `json:"userid"`
+	Name   string `json:"name"`
+}
+
+// Login 企业内免登：前端通过 dd.runtime.permission.requestAuthCode 获取 code
+// code 只能用该企业的 access_token 换取用户，换取成功即证明用户属于 corpid
+func Login(c *gin.Context) {
+	corpId, code := c.PostForm("corpid"), c.PostForm("code")
+	if len(corpId) == 0 || len(code) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing corpid or code"})
+		return
+	}
+
+	user, err := corpUserByCode(corpId, code)
+	if err == ErrTenantNotFound || err == ErrTenantInactive {
+		adminError(c, err)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "login failed"})
+		return
+	}
+
+	// 换发新的 session id，登录前植入的 id 不会绑定到该企业
+	if err = Logins.Login(c.Writer, c.Request, user); err != nil {
+		log.Println(err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+func corpUserByCode(corpId string, code string) (user CorpUser, err error) {
+	client, err := CorpDingClients.ClientFor(corpId)
+	if err != nil {
+		return
+	}
+
+	params := url.Values{}
+	params.Add("code", code)
+	req, _ := http.NewRequest(http.MethodGet, "/user/getuserinfo?"+params.Encode(), nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+
+	result := struct {
+		Errcode int    `json:"errcode"`
+		Errmsg  string `json:"errmsg"`
+		Userid  string `json:"userid"`
+		Name    string `json:"name"`
+	}{}
+	if err = json.Unmarshal(resp, &result); err != nil {
+		return
+	}
+	if result.Errcode != 0 {
+		return user, fmt.Errorf("getuserinfo: %d %s", result.Errcode, result.Errmsg)
+	}
+	if len(result.Userid) == 0 {
+		return user, errors.New("getuserinfo: empty userid")
+	}
+	return CorpUser{CorpId: corpId, Userid: result.Userid, Name: result.Name}, nil
+}
+
+// RequireCorpUser 需已免登，将登录态中的企业与员工写入 context（"corpid" / "user"）
+func RequireCorpUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := Logins.Get(c.Request)
+		user, ok := value.(CorpUser)
+		if !ok || len(user.CorpId) == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "login required"})
+			return
+		}
+		c.Set("corpid", user.CorpId)
+		c.Set("user", user)
+		c.Next()
+	}
+}
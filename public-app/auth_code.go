@@ -0,0 +1,167 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// 已完成的 tmp_auth_code 保留条数，用于忽略钉钉的重复推送
+const authCodeDoneLimit = 100
+
+// PendingAuthCode 已确认收到、尚未换取永久授权码的 tmp_auth_code
+type PendingAuthCode struct {
+	AuthCode  string    `json:"auth_code"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuthCodeQueue 先保存 tmp_auth_code 再响应推送，换取永久授权码与激活在后台进行
+// 同步处理会超过推送的响应时限，钉钉重试时 tmp_auth_code 已被使用，只能失败
+type AuthCodeQueue struct {
+	path string
+
+	MaxAttempts int           `json:"-"`
+	Backoff     time.Duration `json:"-"`
+
+	mu      sync.Mutex
+	Pending []PendingAuthCode `json:"pending"`
+	Done    []string          `json:"done"`
+
+	wake chan struct{}
+}
+
+func NewAuthCodeQueue(path string) (queue *AuthCodeQueue, err error) {
+	queue = &AuthCodeQueue{path: path, MaxAttempts: 5, Backoff: 30 * time.Second, wake: make(chan struct{}, 1)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return queue, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, queue)
+	return
+}
+
+// 调用方持有锁
+func (q *AuthCodeQueue) flush() (err error) {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return
+	}
+
+	tmp := q.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// Enqueue 保存 tmp_auth_code，重复推送直接忽略；返回 nil 后即可响应推送
+func (q *AuthCodeQueue) Enqueue(authCode string) (err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, p := range q.Pending {
+		if p.AuthCode == authCode {
+			return
+		}
+	}
+	for _, code := range q.Done {
+		if code == authCode {
+			return
+		}
+	}
+
+	q.Pending = append(q.Pending, PendingAuthCode{AuthCode: authCode, CreatedAt: time.Now()})
+	if err = q.flush(); err != nil {
+		q.Pending = q.Pending[:len(q.Pending)-1]
+		return
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// Start 处理待换取的 tmp_auth_code，失败的间隔 Backoff 重试，ctx 取消后退出
+func (q *AuthCodeQueue) Start(ctx context.Context, handle func(authCode string) error) {
+	ticker := time.NewTicker(q.Backoff)
+	defer ticker.Stop()
+
+	for {
+		q.mu.Lock()
+		pending := append([]PendingAuthCode(nil), q.Pending...)
+		q.mu.Unlock()
+
+		for _, p := range pending {
+			q.finish(p.AuthCode, handle(p.AuthCode))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// 成功或超过重试次数时移出队列
+func (q *AuthCodeQueue) finish(authCode string, handleErr error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := range q.Pending {
+		if q.Pending[i].AuthCode != authCode {
+			continue
+		}
+
+		p := &q.Pending[i]
+		p.Attempts++
+		switch {
+		case handleErr == nil:
+			q.Done = append(q.Done, authCode)
+			if over := len(q.Done) - authCodeDoneLimit; over > 0 {
+				q.Done = append([]string(nil), q.Done[over:]...)
+			}
+		case p.Attempts >= q.MaxAttempts:
+			log.Printf("tmp_auth_code dropped after %d attempts: %s", p.Attempts, handleErr)
+		default:
+			p.LastError = handleErr.Error()
+			if err := q.flush(); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+
+		q.Pending = append(q.Pending[:i], q.Pending[i+1:]...)
+		if err := q.flush(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthCodeQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth_code.json")
+	queue, err := NewAuthCodeQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.MaxAttempts = 2
+
+	// 重复推送只保存一次
+	for i := 0; i < 2; i++ {
+		if err = queue.Enqueue("code1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(queue.Pending) != 1 {
+		t.Fatalf("pending = %v, want 1 entry", queue.Pending)
+	}
+
+	// 重启后恢复
+	reloaded, err := NewAuthCodeQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.Pending) != 1 || reloaded.Pending[0].AuthCode != "code1" {
+		t.Fatalf("reloaded pending = %v", reloaded.Pending)
+	}
+
+	// 失败保留，超过次数后移出
+	queue.finish("code1", errors.New("timeout"))
+	if len(queue.Pending) != 1 || queue.Pending[0].LastError != "timeout" {
+		t.Fatalf("pending after failure = %v", queue.Pending)
+	}
+	queue.finish("code1", errors.New("timeout"))
+	if len(queue.Pending) != 0 {
+		t.Fatalf("pending after max attempts = %v", queue.Pending)
+	}
+
+	// 成功后再次推送被忽略
+	if err = queue.Enqueue("code2"); err != nil {
+		t.Fatal(err)
+	}
+	queue.finish("code2", nil)
+	if err = queue.Enqueue("code2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue.Pending) != 0 {
+		t.Fatalf("done code re-enqueued: %v", queue.Pending)
+	}
+}
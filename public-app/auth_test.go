@@ -0,0 +1,230 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fastwego/dingding-demo/loginsession"
+	"github.com/fastwego/dingding-demo/tokencache"
+	"github.com/gin-gonic/gin"
+)
+
+type transportFunc func(*http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// 模拟钉钉接口：每个企业的 access_token 只能换取本企业员工的免登 code
+func fakeCorpApi(t *testing.T) {
+	codes := map[string]string{
+		"corp-token-corpA": "code-a",
+		"corp-token-corpB": "code-b",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/service/get_corp_token", func(w http.ResponseWriter, r *http.Request) {
+		payload := map[string]string{}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"errcode":      0,
+			"access_token": "corp-token-" + payload["auth_corpid"],
+			"expires_in":   7200,
+		})
+	})
+	mux.HandleFunc("/user/getuserinfo", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		code, ok := codes[query.Get("access_token")]
+		if !ok || code != query.Get("code") {
+			_, _ = w.Write([]byte(`{"errcode":40078,"errmsg":"不存在的临时授权码"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"errcode":0,"userid":"user-` + code + `","name":"张三"}`))
+	})
+
+	transport := transportFunc(func(r *http.Request) (*http.Response, error) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Result(), nil
+	})
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = transport
+	t.Cleanup(func() { http.DefaultTransport = defaultTransport })
+}
+
+// corpA 已购买 pro 版，corpB 未购买，corpC 已停用
+func newTestApp(t *testing.T) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	fakeCorpApi(t)
+
+	dir := t.TempDir()
+	DingConfig = map[string]string{"SuiteKey": "suite", "GoodsCode": "goods"}
+
+	var err error
+	if SuiteTickets, err = NewSuiteTicketStore(filepath.Join(dir, "suite_ticket.json")); err != nil {
+		t.Fatal(err)
+	}
+	if Tenants, err = NewFileTenantRepository(filepath.Join(dir, "tenants.json")); err != nil {
+		t.Fatal(err)
+	}
+	for corpId, status := range map[string]string{"corpA": TenantActive, "corpB": TenantActive, "corpC": TenantSuspended} {
+		if err = Tenants.SaveTenant(Tenant{CorpId: corpId, Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = Tenants.SaveEntitlement(Entitlement{
+		CorpId:          "corpA",
+		GoodsCode:       "goods",
+		ItemCode:        "pro",
+		Status:          EntitlementActive,
+		ServiceStopTime: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := tokencache.NewFileCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	TokenRefresher = tokencache.NewRefresher(cache)
+	CorpDingClients = NewCorpClients(TokenRefresher)
+	Logins = loginsession.NewStore("gologin", time.Hour, false)
+
+	router := routes()
+	router.GET("/basic", RequireCorpUser(), RequireEdition("goods", "basic"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	return router
+}
+
+func login(router http.Handler, corpId, code string, cookies ...*http.Cookie) (*httptest.ResponseRecorder, *http.Cookie) {
+	form := url.Values{"corpid": {corpId}, "code": {code}}
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == Logins.Name {
+			return w, cookie
+		}
+	}
+	return w, nil
+}
+
+func get(router http.Handler, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestLoginBindsCorp(t *testing.T) {
+	router := newTestApp(t)
+
+	w, cookie := login(router, "corpA", "code-a")
+	if w.Code != http.StatusOK || cookie == nil {
+		t.Fatalf("login = %d %s", w.Code, w.Body.String())
+	}
+	user := CorpUser{}
+	if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil || user.CorpId != "corpA" || user.Userid != "user-code-a" {
+		t.Fatalf("user = %+v, %v", user, err)
+	}
+
+	w = get(router, "/edition", cookie)
+	entitlement := Entitlement{}
+	if err := json.Unmarshal(w.Body.Bytes(), &entitlement); w.Code != http.StatusOK || err != nil || entitlement.CorpId != "corpA" {
+		t.Fatalf("edition = %d %s", w.Code, w.Body.String())
+	}
+
+	// 版本不符
+	if w = get(router, "/basic", cookie); w.Code != http.StatusForbidden {
+		t.Fatalf("basic = %d %s", w.Code, w.Body.String())
+	}
+}
+
+// 企业只取自登录态：其他企业的 code 无法登录，请求参数中的 corpid 被忽略
+func TestLoginRejectsOtherCorpCode(t *testing.T) {
+	router := newTestApp(t)
+
+	w, cookie := login(router, "corpA", "code-b")
+	if w.Code != http.StatusUnauthorized || cookie != nil {
+		t.Fatalf("login with corpB code = %d, cookie %v", w.Code, cookie)
+	}
+
+	_, cookie = login(router, "corpB", "code-b")
+	if cookie == nil {
+		t.Fatal("corpB login failed")
+	}
+	if w = get(router, "/edition?corpid=corpA", cookie); w.Code != http.StatusPaymentRequired {
+		t.Fatalf("corpB edition = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLoginInactiveTenant(t *testing.T) {
+	router := newTestApp(t)
+
+	for corpId, status := range map[string]int{"corpC": http.StatusConflict, "unknown": http.StatusNotFound} {
+		if w, cookie := login(router, corpId, "code-a"); w.Code != status || cookie != nil {
+			t.Errorf("%s: login = %d, cookie %v", corpId, w.Code, cookie)
+		}
+	}
+	if w, _ := login(router, "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("empty login = %d", w.Code)
+	}
+}
+
+func TestEditionRequiresLogin(t *testing.T) {
+	router := newTestApp(t)
+
+	if w := get(router, "/edition?corpid=corpA", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("edition = %d", w.Code)
+	}
+	if w := get(router, "/edition", &http.Cookie{Name: Logins.Name, Value: "forged"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("edition with forged cookie = %d", w.Code)
+	}
+}
+
+func TestLoginRenewsSession(t *testing.T) {
+	router := newTestApp(t)
+
+	// 攻击者以自己企业登录后把 cookie 植入受害者浏览器
+	_, planted := login(router, "corpB", "code-b")
+
+	// 受害者登录后得到新的 id，植入的 id 作废，不会绑定到受害者的企业
+	_, cookie := login(router, "corpA", "code-a", planted)
+	if cookie == nil || cookie.Value == planted.Value {
+		t.Fatalf("session not renewed: %v", cookie)
+	}
+	if w := get(router, "/edition", planted); w.Code != http.StatusUnauthorized {
+		t.Fatalf("planted session = %d %s", w.Code, w.Body.String())
+	}
+	if w := get(router, "/edition", cookie); w.Code != http.StatusOK {
+		t.Fatalf("edition = %d %s", w.Code, w.Body.String())
+	}
+}
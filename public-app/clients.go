@@ -0,0 +1,177 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/faabiosr/cachego"
+	"github.com/fastwego/dingding"
+	"github.com/fastwego/dingding-demo/tokencache"
+	"github.com/fastwego/dingding/util"
+)
+
+// CorpClients 按授权企业隔离的钉钉客户端，首次使用时创建
+type CorpClients struct {
+	cache     cachego.Cache
+	refresher *tokencache.Refresher
+
+	mu      sync.Mutex
+	clients map[string]*corpClient
+}
+
+type corpClient struct {
+	client *dingding.Client
+	atm    *dingding.DefaultAccessTokenManager
+}
+
+func NewCorpClients(refresher *tokencache.Refresher) *CorpClients {
+	return &CorpClients{cache: refresher.Cache, refresher: refresher, clients: map[string]*corpClient{}}
+}
+
+// ClientFor 授权企业的客户端，企业未授权时返回 ErrTenantNotFound
+func (p *CorpClients) ClientFor(corpId string) (*dingding.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if cc, ok := p.clients[corpId]; ok {
+		return cc.client, nil
+	}
+
+	tenant, err := Tenants.Tenant(corpId)
+	if err != nil {
+		return nil, err
+	}
+	if tenant.Status == TenantRemoved || tenant.Status == TenantSuspended {
+		return nil, ErrTenantInactive
+	}
+
+	atm := &dingding.DefaultAccessTokenManager{
+		// 每个企业的 access_token 使用独立的缓存 key
+		Id:    corpManagerId(corpId),
+		Name:  "access_token",
+		Cache: p.cache,
+		GetRefreshRequestFunc: func() *http.Request {
+			return corpTokenRequest(corpId)
+		},
+	}
+
+	// Register 把 atm.Cache 替换为 TrackedCache，记录实际使用的 key 与过期时间
+	cc := &corpClient{client: dingding.NewClient(atm), atm: atm}
+	p.refresher.Register(atm)
+	cc.client.HTTPClient = p.refresher.RetryClient(atm)
+	p.clients[corpId] = cc
+	return cc.client, nil
+}
+
+// 企业 access_token 管理器的 Id
+func corpManagerId(corpId string) string {
+	return DingConfig["SuiteKey"] + ":" + corpId
+}
+
+// Evict 移除企业的客户端并清除缓存的 access_token
+// 按管理器 Id 计算 key 删除，其他副本或重启前缓存的 token 同样被清除
+func (p *CorpClients) Evict(corpId string) {
+	p.mu.Lock()
+	cc, ok := p.clients[corpId]
+	delete(p.clients, corpId)
+	p.mu.Unlock()
+
+	keys := []string{tokencache.ManagerCacheKey(&dingding.DefaultAccessTokenManager{Id: corpManagerId(corpId)})}
+	if ok {
+		p.refresher.Unregister(cc.atm)
+		if tracked, ok := cc.atm.Cache.(*tokencache.TrackedCache); ok && len(tracked.Key()) > 0 && tracked.Key() != keys[0] {
+			keys = append(keys, tracked.Key())
+		}
+	}
+	for _, key := range keys {
+		if err := tokencache.Purge(p.cache, key); err != nil {
+			log.Printf("evict %s: %s", corpId, err)
+		}
+	}
+}
+
+// 第三方企业应用接口的签名参数
+func suiteSignatureParams() url.Values {
+	// 最新推送的 suiteTicket
+	suiteTicket := SuiteTickets.Get().Ticket
+	if len(suiteTicket) == 0 {
+		log.Println("suite_ticket not received yet")
+	}
+
+	// 签名：HmacSHA256(timestamp + "\n" + suiteTicket, SuiteSecret)
+	timestamp := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	params := url.Values{}
+	params.Add("accessKey", DingConfig["SuiteKey"])
+	params.Add("timestamp", timestamp)
+	params.Add("suiteTicket", suiteTicket)
+	params.Add("signature", util.Signature(timestamp+"\n"+suiteTicket, DingConfig["SuiteSecret"]))
+	return params
+}
+
+// TokenExpiry 企业 access_token 的过期时间，未获取过或过期时间未知时为零值
+func (p *CorpClients) TokenExpiry(corpId string) time.Time {
+	p.mu.Lock()
+	cc, ok := p.clients[corpId]
+	p.mu.Unlock()
+
+	if !ok {
+		return time.Time{}
+	}
+	// 共享缓存中的过期时间，其他进程刷新后也能看到
+	return p.refresher.ExpiresAt(cc.atm)
+}
+
+// Refresh 立即重新获取 access_token，新 token 保存前仍使用旧 token
+func (p *CorpClients) Refresh(corpId string) (expiresAt time.Time, err error) {
+	if _, err = p.ClientFor(corpId); err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	cc, ok := p.clients[corpId]
+	p.mu.Unlock()
+	if !ok {
+		return expiresAt, ErrTenantInactive
+	}
+
+	if err = p.refresher.Refresh(cc.atm); err != nil {
+		return
+	}
+	return p.TokenExpiry(corpId), nil
+}
+
+// get_corp_token 请求
+func corpTokenRequest(corpId string) *http.Request {
+	params := suiteSignatureParams()
+
+	data, err := json.Marshal(map[string]string{
+		"auth_corpid": corpId,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, dingding.ServerUrl+"/service/get_corp_token?"+params.Encode(), bytes.NewReader(data))
+
+	return req
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fastwego/dingding"
+	"github.com/fastwego/dingding-demo/tokencache"
+)
+
+func newTestCorpClients(t *testing.T) (*CorpClients, *tokencache.FileCache) {
+	cache, err := tokencache.NewFileCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCorpClients(tokencache.NewRefresher(cache)), cache
+}
+
+func assertPurged(t *testing.T, cache *tokencache.FileCache, key string) {
+	t.Helper()
+	for _, k := range []string{key, key + ":expires_at", key + ":saved_at"} {
+		if cache.Contains(k) {
+			t.Errorf("%s not purged", k)
+		}
+	}
+}
+
+func TestCorpClientsEvict(t *testing.T) {
+	clients, cache := newTestCorpClients(t)
+
+	atm := &dingding.DefaultAccessTokenManager{Id: corpManagerId("corp1"), Name: "access_token", Cache: cache}
+	clients.refresher.Register(atm)
+	clients.clients["corp1"] = &corpClient{client: dingding.NewClient(atm), atm: atm}
+
+	key := tokencache.ManagerCacheKey(atm)
+	if err := atm.Cache.Save(key, "token", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt := clients.TokenExpiry("corp1"); expiresAt.IsZero() {
+		t.Fatal("TokenExpiry is zero")
+	}
+
+	clients.Evict("corp1")
+	assertPurged(t, cache, key)
+	if _, ok := clients.clients["corp1"]; ok {
+		t.Fatal("client not removed")
+	}
+	if tokens := clients.refresher.Tokens(); len(tokens) != 0 {
+		t.Fatalf("manager still registered: %v", tokens)
+	}
+}
+
+// 其他副本或重启前缓存的 token，本进程没有对应的客户端
+func TestCorpClientsEvictWithoutClient(t *testing.T) {
+	clients, cache := newTestCorpClients(t)
+
+	key := tokencache.ManagerCacheKey(&dingding.DefaultAccessTokenManager{Id: corpManagerId("corp2")})
+	tracked := &tokencache.TrackedCache{Cache: cache}
+	if err := tracked.Save(key, "token", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	clients.Evict("corp2")
+	assertPurged(t, cache, key)
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 授权变更事件对应的企业状态
+var lifecycleStatus = map[string]string{
+	"org_suite_auth":        TenantActive,
+	"change_auth":           TenantActive,
+	"org_micro_app_restore": TenantActive,
+	"org_micro_app_stop":    TenantSuspended,
+	"suite_relieve":         TenantRemoved,
+}
+
+// OnTenantLifecycle 处理授权变更事件：更新企业状态、刷新应用信息、清除缓存的 access_token 并记录审计
+func OnTenantLifecycle(eventType string, corpId string) (err error) {
+	status, ok := lifecycleStatus[eventType]
+	if !ok {
+		return fmt.Errorf("unsupported lifecycle event %s", eventType)
+	}
+
+	tenant, err := Tenants.Tenant(corpId)
+	if err == ErrTenantNotFound {
+		// 未经 tmp_auth_code 的授权（如同步推送模式）
+		tenant, err = Tenant{CorpId: corpId, AuthorizedAt: time.Now()}, nil
+	}
+	if err != nil {
+		return
+	}
+	from := tenant.Status
+
+	// 授权范围或状态变化后，已缓存的 access_token 不再可靠
+	CorpDingClients.Evict(corpId)
+
+	tenant.Status = status
+	if err = Tenants.SaveTenant(tenant); err != nil {
+		return
+	}
+
+	var detail string
+	if status == TenantActive {
+		if err := refreshTenantInfo(&tenant); err != nil {
+			// 授权信息可通过后续事件或管理接口再次刷新，不阻塞状态变更
+			log.Printf("refresh %s failed: %s", corpId, err)
+			detail = err.Error()
+		} else if err = Tenants.SaveTenant(tenant); err != nil {
+			return err
+		}
+	}
+
+	return Tenants.AddAudit(TenantAudit{
+		CorpId:     corpId,
+		EventType:  eventType,
+		FromStatus: from,
+		ToStatus:   status,
+		Detail:     detail,
+		CreatedAt:  time.Now(),
+	})
+}
+
+// 刷新企业名称、授权的应用与通讯录范围
+func refreshTenantInfo(tenant *Tenant) (err error) {
+	if err = refreshTenantAgents(tenant); err != nil {
+		return
+	}
+	return refreshTenantScopes(tenant)
+}
+
+// 通过 get_auth_info / get_agent 刷新企业名称与授权的应用
+func refreshTenantAgents(tenant *Tenant) (err error) {
+	payload, err := json.Marshal(map[string]string{
+		"auth_corpid": tenant.CorpId,
+		"suite_key":   DingConfig["SuiteKey"],
+	})
+	if err != nil {
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/service/get_auth_info?"+suiteSignatureParams().Encode(), bytes.NewReader(payload))
+	resp, err := DingClientSuite.Do(req)
+	if err != nil {
+		return
+	}
+	if err = checkErrcode("get_auth_info", resp); err != nil {
+		return
+	}
+
+	authInfo := struct {
+		AuthCorpInfo struct {
+			CorpName string `json:"corp_name"`
+		} `json:"auth_corp_info"`
+		AuthInfo struct {
+			Agent []struct {
+				AgentId int64 `json:"agentid"`
+				AppId   int64 `json:"appid"`
+			} `json:"agent"`
+		} `json:"auth_info"`
+	}{}
+	if err = json.Unmarshal(resp, &authInfo); err != nil {
+		return
+	}
+
+	agents := make([]Agent, 0, len(authInfo.AuthInfo.Agent))
+	for _, a := range authInfo.AuthInfo.Agent {
+		agent, err := fetchAgent(tenant.CorpId, a.AgentId)
+		if err != nil {
+			return err
+		}
+		agent.AppId = a.AppId
+		agents = append(agents, agent)
+	}
+
+	tenant.CorpName = authInfo.AuthCorpInfo.CorpName
+	tenant.Agents = agents
+	return
+}
+
+func fetchAgent(corpId string, agentId int64) (agent Agent, err error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"suite_key":   DingConfig["SuiteKey"],
+		"auth_corpid": corpId,
+		"agentid":     agentId,
+	})
+	if err != nil {
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/service/get_agent?"+suiteSignatureParams().Encode(), bytes.NewReader(payload))
+	resp, err := DingClientSuite.Do(req)
+	if err != nil {
+		return
+	}
+	if err = checkErrcode("get_agent", resp); err != nil {
+		return
+	}
+
+	err = json.Unmarshal(resp, &agent)
+	return
+}
+
+// 通过 /auth/scopes 刷新通讯录授权范围
+func refreshTenantScopes(tenant *Tenant) (err error) {
+	client, err := CorpDingClients.ClientFor(tenant.CorpId)
+	if err != nil {
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/auth/scopes", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	if err = checkErrcode("auth/scopes", resp); err != nil {
+		return
+	}
+
+	scopes := &AuthScopes{}
+	if err = json.Unmarshal(resp, scopes); err != nil {
+		return
+	}
+	tenant.AuthScopes = scopes
+	return
+}
@@ -18,18 +18,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
-	"github.com/faabiosr/cachego/file"
-
-	"github.com/fastwego/dingding/util"
+	"github.com/fastwego/dingding-demo/loginsession"
+	"github.com/fastwego/dingding-demo/tokencache"
 
 	"github.com/fastwego/dingding"
 
@@ -37,80 +36,85 @@ import (
 	"github.com/spf13/viper"
 )
 
-var DingClient *dingding.Client
+var CorpDingClients *CorpClients
 var DingClientSuite *dingding.Client
 
 var DingConfig map[string]string
-
-func init() {
+var TokenRefresher *tokencache.Refresher
+var TokenAudits *tokencache.AuditLog
+var SuiteTickets *SuiteTicketStore
+var AuthCodes *AuthCodeQueue
+var Tenants TenantRepository
+var Logins *loginsession.Store
+
+// 加载配置，初始化授权企业存储与各 token 管理器
+func setup() {
 	// 加载配置文件
 	viper.SetConfigFile(".env")
 	_ = viper.ReadInConfig()
 
+	viper.SetDefault("SuiteTicketFile", "suite_ticket.json")
+	viper.SetDefault("AuthCodeFile", "auth_code.json")
+	viper.SetDefault("TenantStore", "sqlite")
+	viper.SetDefault("TenantDB", "tenants.db")
+	viper.SetDefault("TenantFile", "tenants.json")
+
 	DingConfig = map[string]string{
-		"SuiteKey":    viper.GetString("SuiteKey"),
-		"SuiteSecret": viper.GetString("SuiteSecret"),
+		"SuiteKey":       viper.GetString("SuiteKey"),
+		"SuiteSecret":    viper.GetString("SuiteSecret"),
+		"Token":          viper.GetString("TOKEN"),
+		"EncodingAESKey": viper.GetString("EncodingAESKey"),
+		"AdminToken":     viper.GetString("AdminToken"),
+		"GoodsCode":      viper.GetString("GoodsCode"),
 	}
 
-	// 自定义获取 auth_corpid
-	authCorpId := func() (corpId string) {
-		return "authCorpId"
-	}()
-
-	// 钉钉 AccessToken 管理器
-	atm := &dingding.DefaultAccessTokenManager{
-		Id:    DingConfig["SuiteKey"],
-		Name:  "access_token",
-		Cache: file.New(os.TempDir()),
-		GetRefreshRequestFunc: func() *http.Request {
-			// 自定义获取 suiteTicket
-
-			suiteTicket := func() (suiteTicket string) {
-				return "suiteTicket"
-			}()
-			params := map[string]string{
-				"accessKey":    DingConfig["SuiteKey"],
-				"accessSecret": DingConfig["SuiteSecret"],
-				"suiteTicket":  suiteTicket,
-				"signature":    util.Signature(suiteTicket, DingConfig["SuiteSecret"]),
-				"auth_corpid":  authCorpId,
-			}
-			data, err := json.Marshal(params)
-			if err != nil {
-				panic(err)
-			}
-
-			log.Printf(string(data))
-
-			req, _ := http.NewRequest(http.MethodPost, dingding.ServerUrl+"/service/get_corp_token", bytes.NewReader(data))
+	// 钉钉推送的 suite_ticket
+	var err error
+	SuiteTickets, err = NewSuiteTicketStore(viper.GetString("SuiteTicketFile"))
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-			return req
-		},
+	// 待换取永久授权码的 tmp_auth_code
+	AuthCodes, err = NewAuthCodeQueue(viper.GetString("AuthCodeFile"))
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	// 钉钉 客户端
-	DingClient = dingding.NewClient(atm)
+	// 授权企业
+	switch store := viper.GetString("TenantStore"); store {
+	case "sqlite":
+		Tenants, err = NewSQLiteTenantRepository(viper.GetString("TenantDB"))
+	case "file":
+		Tenants, err = NewFileTenantRepository(viper.GetString("TenantFile"))
+	default:
+		err = fmt.Errorf("unknown TenantStore %s", store)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	// 钉钉 SuiteAccessToken 管理器
 	satm := &dingding.DefaultAccessTokenManager{
-		Id:    DingConfig["SuiteKey"],
-		Name:  "suite_access_token",
-		Cache: file.New(os.TempDir()),
+		Id:   DingConfig["SuiteKey"],
+		Name: "suite_access_token",
 		GetRefreshRequestFunc: func() *http.Request {
+			// 最新推送的 suiteTicket
+			suiteTicket := SuiteTickets.Get().Ticket
+			if len(suiteTicket) == 0 {
+				log.Println("suite_ticket not received yet")
+			}
+
 			params := map[string]string{
 				"suite_key":    DingConfig["SuiteKey"],
 				"suite_secret": DingConfig["SuiteSecret"],
-				"suite_ticket": func() (suiteTicket string) {
-					return "suiteTicket"
-				}(),
+				"suite_ticket": suiteTicket,
 			}
 			data, err := json.Marshal(params)
 			if err != nil {
 				panic(err)
 			}
 
-			log.Printf(string(data))
-
 			req, _ := http.NewRequest(http.MethodPost, dingding.ServerUrl+"/service/get_suite_token", bytes.NewReader(data))
 
 			return req
@@ -119,35 +123,53 @@ func init() {
 
 	DingClientSuite = dingding.NewClient(satm)
 
+	// suite_access_token 缓存、后台刷新与吊销后重试，后端由 TokenCache 配置
+	TokenRefresher, TokenAudits, DingClientSuite.HTTPClient, err = tokencache.Setup(satm)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// 授权企业的客户端，与 suite_access_token 共用缓存并由同一个 Refresher 刷新
+	CorpDingClients = NewCorpClients(TokenRefresher)
+
+	// 已授权企业的客户端，启动后即纳入后台刷新，并出现在 token 管理接口中
+	tenants, err := Tenants.Tenants()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, tenant := range tenants {
+		if tenant.Status != TenantActive {
+			continue
+		}
+		if _, err := CorpDingClients.ClientFor(tenant.CorpId); err != nil {
+			log.Printf("client for %s: %s", tenant.CorpId, err)
+		}
+	}
+
+	// 免登的企业与员工，登录成功后换发新的 session id
+	Logins = loginsession.NewStore("gologin", 24*time.Hour, false)
 }
-func main() {
 
+func routes() *gin.Engine {
 	router := gin.New()
 	router.Use(gin.Logger(), gin.Recovery())
 
-	// 调用接口
-	router.GET("/user/get_by_mobile", func(c *gin.Context) {
-		params := url.Values{}
-		params.Add("mobile", "13800138000")
+	// 企业内免登
+	router.POST("/login", Login)
 
-		req, _ := http.NewRequest(http.MethodGet, "/user/get_by_mobile?"+params.Encode(), nil)
-		get, err := DingClient.Do(req)
+	// 调用接口：企业取自免登的 session
+	router.GET("/user/get_by_mobile", RequireCorpUser(), func(c *gin.Context) {
+		client, err := CorpDingClients.ClientFor(c.GetString("corpid"))
 		if err != nil {
 			log.Println(err)
 			return
 		}
-		log.Println(string(get))
-	})
 
-	// 激活应用
-	router.GET("/service/activate_suite", func(c *gin.Context) {
+		params := url.Values{}
+		params.Add("mobile", "13800138000")
 
-		payload := `{
-        "auth_corpid":"ding1234",
-        "suite_key":"suitexxxx"
-}`
-		req, _ := http.NewRequest(http.MethodPost, "/service/activate_suite", strings.NewReader(payload))
-		get, err := DingClientSuite.Do(req)
+		req, _ := http.NewRequest(http.MethodGet, "/user/get_by_mobile?"+params.Encode(), nil)
+		get, err := client.Do(req)
 		if err != nil {
 			log.Println(err)
 			return
@@ -155,9 +177,36 @@ func main() {
 		log.Println(string(get))
 	})
 
+	// 按已购版本限制功能
+	router.GET("/edition", RequireCorpUser(), RequireEdition(DingConfig["GoodsCode"]), func(c *gin.Context) {
+		c.JSON(http.StatusOK, c.MustGet("entitlement"))
+	})
+
+	// 套件事件回调
+	router.POST("/api/dingding/suite/callback", SuiteCallback)
+
+	// 管理接口
+	admin := router.Group("/admin", tokencache.AdminAuth(DingConfig["AdminToken"]))
+	admin.GET("/tenants", AdminTenants)
+	admin.GET("/tenants/:corpid", AdminTenant)
+	admin.POST("/tenants/:corpid/refresh-token", AdminRefreshTenantToken)
+	admin.GET("/tenants/:corpid/orders", AdminTenantOrders)
+	admin.GET("/activations", AdminActivations)
+	admin.POST("/tenants/:corpid/activate", AdminActivateTenant)
+	admin.GET("/audits", AdminTenantAudits)
+
+	// suite_access_token 与各企业 access_token 的查看、强制刷新
+	tokencache.NewAdmin(TokenRefresher, TokenAudits).RegisterRoutes(admin)
+
+	return router
+}
+
+func main() {
+	setup()
+
 	svr := &http.Server{
 		Addr:    viper.GetString("LISTEN"),
-		Handler: router,
+		Handler: routes(),
 	}
 
 	go func() {
@@ -167,6 +216,14 @@ func main() {
 		}
 	}()
 
+	// 过期前后台刷新 token
+	refreshCtx, stopRefresh := context.WithCancel(context.Background())
+	defer stopRefresh()
+	go TokenRefresher.Start(refreshCtx)
+
+	// 换取永久授权码并激活，推送响应后在后台进行
+	go AuthCodes.Start(refreshCtx, onTmpAuthCode)
+
 	quit := make(chan os.Signal)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
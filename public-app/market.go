@@ -0,0 +1,228 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrNoEntitlement 企业未购买或已过期
+var ErrNoEntitlement = errors.New("no entitlement")
+
+// 权益状态
+const (
+	EntitlementActive = "active"
+	EntitlementClosed = "closed" // 服务已关闭
+)
+
+// Order 应用市场订单
+type Order struct {
+	OrderId          string    `json:"order_id"`
+	CorpId           string    `json:"corp_id"`
+	GoodsCode        string    `json:"goods_code"`
+	ItemCode         string    `json:"item_code"` // 规格码，对应版本
+	ItemName         string    `json:"item_name"`
+	SubQuantity      int64     `json:"sub_quantity"`
+	MaxOfPeople      int64     `json:"max_of_people"`
+	PayFee           int64     `json:"pay_fee"` // 分
+	PaidTime         time.Time `json:"paid_time"`
+	ServiceStartTime time.Time `json:"service_start_time"`
+	ServiceStopTime  time.Time `json:"service_stop_time"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// Entitlement 企业当前可用的版本，每个商品一条
+type Entitlement struct {
+	CorpId          string    `json:"corp_id"`
+	GoodsCode       string    `json:"goods_code"`
+	ItemCode        string    `json:"item_code"`
+	ItemName        string    `json:"item_name"`
+	MaxOfPeople     int64     `json:"max_of_people"`
+	OrderId         string    `json:"order_id"`
+	PaidTime        time.Time `json:"paid_time"`
+	ServiceStopTime time.Time `json:"service_stop_time"`
+	Status          string    `json:"status"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Valid 服务未关闭且未过期
+func (e Entitlement) Valid(now time.Time) bool {
+	return e.Status == EntitlementActive && now.Before(e.ServiceStopTime)
+}
+
+// 应用市场事件：market_buy 使用 buyCorpId，market_order / market_service_close 使用 corpId
+type marketEvent struct {
+	EventType        string      `json:"EventType"`
+	BuyCorpId        string      `json:"buyCorpId"`
+	CorpId           string      `json:"corpId"`
+	GoodsCode        string      `json:"goodsCode"`
+	ItemCode         string      `json:"itemCode"`
+	ItemName         string      `json:"itemName"`
+	SubQuantity      json.Number `json:"subQuantity"`
+	MaxOfPeople      json.Number `json:"maxOfPeople"`
+	OrderId          json.Number `json:"orderId"`
+	PayFee           json.Number `json:"payFee"`
+	PaidTime         json.Number `json:"paidtime"`
+	ServiceStartTime json.Number `json:"serviceStartTime"`
+	ServiceStopTime  json.Number `json:"serviceStopTime"`
+}
+
+func (e marketEvent) corpId() string {
+	if len(e.BuyCorpId) > 0 {
+		return e.BuyCorpId
+	}
+	return e.CorpId
+}
+
+// 毫秒时间戳
+func millisTime(n json.Number) time.Time {
+	ms, err := n.Int64()
+	if err != nil || ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func numberInt64(n json.Number) int64 {
+	v, _ := n.Int64()
+	return v
+}
+
+// OnMarketEvent 处理应用市场订单与服务关闭事件
+func OnMarketEvent(decryptMsg []byte) (err error) {
+	evt := marketEvent{}
+	if err = json.Unmarshal(decryptMsg, &evt); err != nil {
+		return
+	}
+	corpId := evt.corpId()
+	if len(corpId) == 0 || len(evt.GoodsCode) == 0 {
+		return fmt.Errorf("%s without corpId or goodsCode", evt.EventType)
+	}
+
+	switch evt.EventType {
+	case "market_buy", "market_order":
+		return onMarketOrder(corpId, evt)
+	case "market_service_close":
+		return onMarketServiceClose(corpId, evt)
+	}
+	return fmt.Errorf("unsupported market event %s", evt.EventType)
+}
+
+func onMarketOrder(corpId string, evt marketEvent) (err error) {
+	order := Order{
+		OrderId:          evt.OrderId.String(),
+		CorpId:           corpId,
+		GoodsCode:        evt.GoodsCode,
+		ItemCode:         evt.ItemCode,
+		ItemName:         evt.ItemName,
+		SubQuantity:      numberInt64(evt.SubQuantity),
+		MaxOfPeople:      numberInt64(evt.MaxOfPeople),
+		PayFee:           numberInt64(evt.PayFee),
+		PaidTime:         millisTime(evt.PaidTime),
+		ServiceStartTime: millisTime(evt.ServiceStartTime),
+		ServiceStopTime:  millisTime(evt.ServiceStopTime),
+		CreatedAt:        time.Now(),
+	}
+	if len(order.OrderId) == 0 {
+		return fmt.Errorf("%s without orderId", evt.EventType)
+	}
+
+	// 重复推送按订单号覆盖
+	if err = Tenants.SaveOrder(order); err != nil {
+		return
+	}
+
+	current, err := Tenants.Entitlement(corpId, order.GoodsCode)
+	if err != nil && err != ErrNoEntitlement {
+		return
+	}
+	// 乱序到达的旧订单不覆盖当前版本
+	if err == nil && order.PaidTime.Before(current.PaidTime) {
+		return nil
+	}
+
+	return Tenants.SaveEntitlement(Entitlement{
+		CorpId:          corpId,
+		GoodsCode:       order.GoodsCode,
+		ItemCode:        order.ItemCode,
+		ItemName:        order.ItemName,
+		MaxOfPeople:     order.MaxOfPeople,
+		OrderId:         order.OrderId,
+		PaidTime:        order.PaidTime,
+		ServiceStopTime: order.ServiceStopTime,
+		Status:          EntitlementActive,
+	})
+}
+
+func onMarketServiceClose(corpId string, evt marketEvent) (err error) {
+	entitlement, err := Tenants.Entitlement(corpId, evt.GoodsCode)
+	if err == ErrNoEntitlement {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	entitlement.Status = EntitlementClosed
+	if stop := millisTime(evt.ServiceStopTime); !stop.IsZero() {
+		entitlement.ServiceStopTime = stop
+	}
+	return Tenants.SaveEntitlement(entitlement)
+}
+
+// RequireEdition 按已购版本限制功能：企业需购买 goodsCode 的 itemCodes 之一且未过期
+// itemCodes 为空时任意版本均可；企业取自 RequireCorpUser 写入的 corpid，不信任请求参数
+func RequireEdition(goodsCode string, itemCodes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		corpId := c.GetString("corpid")
+		if len(corpId) == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "login required"})
+			return
+		}
+
+		entitlement, err := Tenants.Entitlement(corpId, goodsCode)
+		if err == ErrNoEntitlement || (err == nil && !entitlement.Valid(time.Now())) {
+			c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{"error": ErrNoEntitlement.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(itemCodes) > 0 {
+			allowed := false
+			for _, itemCode := range itemCodes {
+				if entitlement.ItemCode == itemCode {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "edition not allowed", "item_code": entitlement.ItemCode})
+				return
+			}
+		}
+
+		c.Set("entitlement", entitlement)
+		c.Next()
+	}
+}
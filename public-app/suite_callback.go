@@ -0,0 +1,113 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/fastwego/dingding"
+	"github.com/gin-gonic/gin"
+)
+
+// 套件事件的公共字段
+type suiteEvent struct {
+	EventType string      `json:"EventType"`
+	SuiteKey  string      `json:"SuiteKey"`
+	TimeStamp json.Number `json:"TimeStamp"`
+
+	// check_create_suite_url / check_update_suite_url
+	Random string `json:"Random"`
+
+	// suite_ticket
+	SuiteTicket string `json:"SuiteTicket"`
+
+	// tmp_auth_code
+	AuthCode string `json:"AuthCode"`
+
+	// 授权变更事件
+	AuthCorpId string `json:"AuthCorpId"`
+}
+
+// SuiteCallback 应用套件事件回调
+func SuiteCallback(c *gin.Context) {
+
+	// 加解密处理器：第三方企业应用使用 SuiteKey
+	dingCrypto := dingding.NewCrypto(DingConfig["Token"], DingConfig["EncodingAESKey"], DingConfig["SuiteKey"])
+
+	// Post Body
+	bytes, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	msgJson := struct {
+		Encrypt string `json:"encrypt"`
+	}{}
+	err = json.Unmarshal(bytes, &msgJson)
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	timestamp := c.Request.URL.Query().Get("timestamp")
+	nonce := c.Request.URL.Query().Get("nonce")
+	signature := c.Request.URL.Query().Get("signature")
+	decryptMsg, err := dingCrypto.GetDecryptMsg(timestamp, nonce, signature, msgJson.Encrypt)
+	if err != nil {
+		log.Println(err)
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	evt := suiteEvent{}
+	err = json.Unmarshal(decryptMsg, &evt)
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	reply := "success"
+
+	switch evt.EventType {
+	case "check_create_suite_url", "check_update_suite_url":
+		// 创建/修改套件时校验回调地址，需响应 Random
+		reply = evt.Random
+	case "suite_ticket":
+		ticketTime, _ := evt.TimeStamp.Int64()
+		err = SuiteTickets.Save(evt.SuiteTicket, ticketTime)
+	case "tmp_auth_code":
+		// 企业授权：先保存再响应，换取永久授权码并激活应用在后台进行
+		err = AuthCodes.Enqueue(evt.AuthCode)
+	case "org_suite_auth", "change_auth", "suite_relieve", "org_micro_app_stop", "org_micro_app_restore":
+		// 授权变更
+		err = OnTenantLifecycle(evt.EventType, evt.AuthCorpId)
+	case "market_buy", "market_order", "market_service_close":
+		// 应用市场订单与服务关闭
+		err = OnMarketEvent(decryptMsg)
+	}
+
+	// 处理失败不响应 success，由钉钉重试推送
+	if err != nil {
+		log.Println(evt.EventType, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, dingCrypto.GetEncryptMsg(reply))
+}
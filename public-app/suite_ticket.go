@@ -0,0 +1,87 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// SuiteTicket 钉钉定时推送的 suite_ticket
+type SuiteTicket struct {
+	Ticket    string    `json:"ticket"`
+	TimeStamp int64     `json:"timestamp"` // 推送中的 TimeStamp（毫秒）
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SuiteTicketStore 保存最新的 suite_ticket，重启后从文件恢复
+type SuiteTicketStore struct {
+	path string
+
+	mu      sync.RWMutex
+	current SuiteTicket
+}
+
+func NewSuiteTicketStore(path string) (store *SuiteTicketStore, err error) {
+	store = &SuiteTicketStore{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &store.current)
+	return
+}
+
+// Get 最新的 suite_ticket
+func (s *SuiteTicketStore) Get() SuiteTicket {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.current
+}
+
+// Save 保存推送的 suite_ticket，忽略比当前更早的推送
+func (s *SuiteTicketStore) Save(ticket string, timestamp int64) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if timestamp < s.current.TimeStamp {
+		return
+	}
+
+	next := SuiteTicket{Ticket: ticket, TimeStamp: timestamp, UpdatedAt: time.Now()}
+	data, err := json.Marshal(next)
+	if err != nil {
+		return
+	}
+
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return
+	}
+
+	s.current = next
+	return
+}
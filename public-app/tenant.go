@@ -0,0 +1,304 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrTenantNotFound 企业未授权
+var ErrTenantNotFound = errors.New("tenant not found")
+
+// ErrTenantInactive 企业已解除授权或停用应用
+var ErrTenantInactive = errors.New("tenant inactive")
+
+// 授权企业状态
+const (
+	TenantAuthorized = "authorized" // 已获取永久授权码，尚未激活
+	TenantActive     = "active"
+	TenantSuspended  = "suspended" // 应用已停用
+	TenantRemoved    = "removed"   // 已解除授权
+)
+
+// Tenant 授权企业
+type Tenant struct {
+	CorpId        string      `json:"corp_id"`
+	CorpName      string      `json:"corp_name"`
+	PermanentCode string      `json:"permanent_code"`
+	Status        string      `json:"status"`
+	Agents        []Agent     `json:"agents"`
+	AuthScopes    *AuthScopes `json:"auth_scopes"`
+	AuthorizedAt  time.Time   `json:"authorized_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+}
+
+// AuthScopes 企业授权的通讯录范围（/auth/scopes）
+type AuthScopes struct {
+	AuthUserField  []string `json:"auth_user_field"`
+	ConditionField []string `json:"condition_field"`
+	AuthOrgScopes  struct {
+		AuthedDept []int64  `json:"authed_dept"`
+		AuthedUser []string `json:"authed_user"`
+	} `json:"auth_org_scopes"`
+}
+
+// Agent 企业授权的应用
+type Agent struct {
+	AgentId     int64  `json:"agentid"`
+	AppId       int64  `json:"appid"`
+	Name        string `json:"name"`
+	LogoUrl     string `json:"logo_url"`
+	Description string `json:"description"`
+	Close       int    `json:"close"` // 0 禁用 1 正常 2 待激活
+}
+
+// TenantAudit 授权企业的一次变更
+type TenantAudit struct {
+	CorpId     string    `json:"corp_id"`
+	EventType  string    `json:"event_type"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Detail     string    `json:"detail,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Activation 一次激活尝试
+type Activation struct {
+	CorpId    string    `json:"corp_id"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TenantRepository 授权企业存储
+type TenantRepository interface {
+	SaveTenant(tenant Tenant) error
+	// Tenant 不存在时返回 ErrTenantNotFound
+	Tenant(corpId string) (Tenant, error)
+	Tenants() ([]Tenant, error)
+
+	AddActivation(activation Activation) error
+	// Activations corpId 为空时返回全部
+	Activations(corpId string) ([]Activation, error)
+
+	AddAudit(audit TenantAudit) error
+	// Audits corpId 为空时返回全部
+	Audits(corpId string) ([]TenantAudit, error)
+
+	// SaveOrder 按订单号覆盖
+	SaveOrder(order Order) error
+	Orders(corpId string) ([]Order, error)
+	SaveEntitlement(entitlement Entitlement) error
+	// Entitlement 不存在时返回 ErrNoEntitlement
+	Entitlement(corpId string, goodsCode string) (Entitlement, error)
+	Entitlements(corpId string) ([]Entitlement, error)
+}
+
+// FileTenantRepository json 文件存储
+type FileTenantRepository struct {
+	path string
+
+	mu   sync.Mutex
+	data struct {
+		Tenants      map[string]Tenant      `json:"tenants"`
+		Activations  []Activation           `json:"activations"`
+		Audits       []TenantAudit          `json:"audits"`
+		Orders       map[string]Order       `json:"orders"`
+		Entitlements map[string]Entitlement `json:"entitlements"` // corpId:goodsCode
+	}
+}
+
+func NewFileTenantRepository(path string) (repo *FileTenantRepository, err error) {
+	repo = &FileTenantRepository{path: path}
+	repo.data.Tenants = map[string]Tenant{}
+	repo.data.Orders = map[string]Order{}
+	repo.data.Entitlements = map[string]Entitlement{}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return repo, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &repo.data); err != nil {
+		return
+	}
+	// 旧版本文件中没有订单
+	if repo.data.Orders == nil {
+		repo.data.Orders = map[string]Order{}
+	}
+	if repo.data.Entitlements == nil {
+		repo.data.Entitlements = map[string]Entitlement{}
+	}
+	return
+}
+
+// 调用方持有锁
+func (r *FileTenantRepository) flush() (err error) {
+	data, err := json.Marshal(r.data)
+	if err != nil {
+		return
+	}
+
+	// 包含永久授权码，仅当前用户可读
+	tmp := r.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, r.path)
+}
+
+func (r *FileTenantRepository) SaveTenant(tenant Tenant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tenant.UpdatedAt = time.Now()
+	r.data.Tenants[tenant.CorpId] = tenant
+	return r.flush()
+}
+
+func (r *FileTenantRepository) Tenant(corpId string) (Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tenant, ok := r.data.Tenants[corpId]
+	if !ok {
+		return tenant, ErrTenantNotFound
+	}
+	return tenant, nil
+}
+
+func (r *FileTenantRepository) Tenants() ([]Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tenants := make([]Tenant, 0, len(r.data.Tenants))
+	for _, tenant := range r.data.Tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].CorpId < tenants[j].CorpId
+	})
+	return tenants, nil
+}
+
+func (r *FileTenantRepository) AddActivation(activation Activation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.data.Activations = append(r.data.Activations, activation)
+	return r.flush()
+}
+
+func (r *FileTenantRepository) Activations(corpId string) ([]Activation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	activations := []Activation{}
+	for _, activation := range r.data.Activations {
+		if len(corpId) == 0 || activation.CorpId == corpId {
+			activations = append(activations, activation)
+		}
+	}
+	return activations, nil
+}
+
+func (r *FileTenantRepository) AddAudit(audit TenantAudit) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.data.Audits = append(r.data.Audits, audit)
+	return r.flush()
+}
+
+func (r *FileTenantRepository) Audits(corpId string) ([]TenantAudit, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	audits := []TenantAudit{}
+	for _, audit := range r.data.Audits {
+		if len(corpId) == 0 || audit.CorpId == corpId {
+			audits = append(audits, audit)
+		}
+	}
+	return audits, nil
+}
+
+func (r *FileTenantRepository) SaveOrder(order Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.data.Orders[order.OrderId] = order
+	return r.flush()
+}
+
+func (r *FileTenantRepository) Orders(corpId string) ([]Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	orders := []Order{}
+	for _, order := range r.data.Orders {
+		if order.CorpId == corpId {
+			orders = append(orders, order)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].PaidTime.Before(orders[j].PaidTime)
+	})
+	return orders, nil
+}
+
+func (r *FileTenantRepository) SaveEntitlement(entitlement Entitlement) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entitlement.UpdatedAt = time.Now()
+	r.data.Entitlements[entitlement.CorpId+":"+entitlement.GoodsCode] = entitlement
+	return r.flush()
+}
+
+func (r *FileTenantRepository) Entitlement(corpId string, goodsCode string) (Entitlement, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entitlement, ok := r.data.Entitlements[corpId+":"+goodsCode]
+	if !ok {
+		return entitlement, ErrNoEntitlement
+	}
+	return entitlement, nil
+}
+
+func (r *FileTenantRepository) Entitlements(corpId string) ([]Entitlement, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entitlements := []Entitlement{}
+	for _, entitlement := range r.data.Entitlements {
+		if entitlement.CorpId == corpId {
+			entitlements = append(entitlements, entitlement)
+		}
+	}
+	sort.Slice(entitlements, func(i, j int) bool {
+		return entitlements[i].GoodsCode < entitlements[j].GoodsCode
+	})
+	return entitlements, nil
+}
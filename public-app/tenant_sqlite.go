@@ -0,0 +1,321 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const tenantSchema = `
+CREATE TABLE IF NOT EXISTS tenants (
+	corp_id        TEXT PRIMARY KEY,
+	corp_name      TEXT    NOT NULL DEFAULT '',
+	permanent_code TEXT    NOT NULL DEFAULT '',
+	status         TEXT    NOT NULL DEFAULT '',
+	agents         TEXT    NOT NULL DEFAULT '[]',
+	auth_scopes    TEXT    NOT NULL DEFAULT 'null',
+	authorized_at  INTEGER NOT NULL DEFAULT 0,
+	updated_at     INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tenant_activations (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	corp_id    TEXT    NOT NULL,
+	success    INTEGER NOT NULL,
+	error      TEXT    NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS tenant_activations_corp_id ON tenant_activations (corp_id);
+CREATE TABLE IF NOT EXISTS tenant_audits (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	corp_id     TEXT    NOT NULL,
+	event_type  TEXT    NOT NULL,
+	from_status TEXT    NOT NULL DEFAULT '',
+	to_status   TEXT    NOT NULL DEFAULT '',
+	detail      TEXT    NOT NULL DEFAULT '',
+	created_at  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS tenant_audits_corp_id ON tenant_audits (corp_id);
+CREATE TABLE IF NOT EXISTS tenant_orders (
+	order_id           TEXT PRIMARY KEY,
+	corp_id            TEXT    NOT NULL,
+	goods_code         TEXT    NOT NULL,
+	item_code          TEXT    NOT NULL DEFAULT '',
+	item_name          TEXT    NOT NULL DEFAULT '',
+	sub_quantity       INTEGER NOT NULL DEFAULT 0,
+	max_of_people      INTEGER NOT NULL DEFAULT 0,
+	pay_fee            INTEGER NOT NULL DEFAULT 0,
+	paid_time          INTEGER NOT NULL DEFAULT 0,
+	service_start_time INTEGER NOT NULL DEFAULT 0,
+	service_stop_time  INTEGER NOT NULL DEFAULT 0,
+	created_at         INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS tenant_orders_corp_id ON tenant_orders (corp_id);
+CREATE TABLE IF NOT EXISTS tenant_entitlements (
+	corp_id           TEXT    NOT NULL,
+	goods_code        TEXT    NOT NULL,
+	item_code         TEXT    NOT NULL DEFAULT '',
+	item_name         TEXT    NOT NULL DEFAULT '',
+	max_of_people     INTEGER NOT NULL DEFAULT 0,
+	order_id          TEXT    NOT NULL DEFAULT '',
+	paid_time         INTEGER NOT NULL DEFAULT 0,
+	service_stop_time INTEGER NOT NULL DEFAULT 0,
+	status            TEXT    NOT NULL,
+	updated_at        INTEGER NOT NULL,
+	PRIMARY KEY (corp_id, goods_code)
+);
+`
+
+// SQLiteTenantRepository SQLite 存储
+type SQLiteTenantRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteTenantRepository(path string) (repo *SQLiteTenantRepository, err error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return
+	}
+	// SQLite 单写者，避免 database is locked
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(tenantSchema); err != nil {
+		return
+	}
+	return &SQLiteTenantRepository{db: db}, nil
+}
+
+// 零值时间存为 0
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func (r *SQLiteTenantRepository) SaveTenant(tenant Tenant) (err error) {
+	agents, err := json.Marshal(tenant.Agents)
+	if err != nil {
+		return
+	}
+	scopes, err := json.Marshal(tenant.AuthScopes)
+	if err != nil {
+		return
+	}
+
+	_, err = r.db.Exec(`INSERT INTO tenants (corp_id, corp_name, permanent_code, status, agents, auth_scopes, authorized_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (corp_id) DO UPDATE SET corp_name = excluded.corp_name, permanent_code = excluded.permanent_code,
+			status = excluded.status, agents = excluded.agents, auth_scopes = excluded.auth_scopes,
+			authorized_at = excluded.authorized_at, updated_at = excluded.updated_at`,
+		tenant.CorpId, tenant.CorpName, tenant.PermanentCode, tenant.Status, string(agents), string(scopes),
+		unixTime(tenant.AuthorizedAt), time.Now().Unix())
+	return
+}
+
+func scanTenant(row interface{ Scan(...interface{}) error }) (tenant Tenant, err error) {
+	var agents, scopes string
+	var authorizedAt, updatedAt int64
+	err = row.Scan(&tenant.CorpId, &tenant.CorpName, &tenant.PermanentCode, &tenant.Status, &agents, &scopes, &authorizedAt, &updatedAt)
+	if err != nil {
+		return
+	}
+	tenant.AuthorizedAt = fromUnix(authorizedAt)
+	tenant.UpdatedAt = fromUnix(updatedAt)
+
+	if err = json.Unmarshal([]byte(agents), &tenant.Agents); err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(scopes), &tenant.AuthScopes)
+	return
+}
+
+const tenantColumns = `corp_id, corp_name, permanent_code, status, agents, auth_scopes, authorized_at, updated_at`
+
+func (r *SQLiteTenantRepository) Tenant(corpId string) (tenant Tenant, err error) {
+	tenant, err = scanTenant(r.db.QueryRow(`SELECT `+tenantColumns+` FROM tenants WHERE corp_id = ?`, corpId))
+	if err == sql.ErrNoRows {
+		err = ErrTenantNotFound
+	}
+	return
+}
+
+func (r *SQLiteTenantRepository) Tenants() (tenants []Tenant, err error) {
+	rows, err := r.db.Query(`SELECT ` + tenantColumns + ` FROM tenants ORDER BY corp_id`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	tenants = []Tenant{}
+	for rows.Next() {
+		tenant, err := scanTenant(rows)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+func (r *SQLiteTenantRepository) AddActivation(activation Activation) (err error) {
+	_, err = r.db.Exec(`INSERT INTO tenant_activations (corp_id, success, error, created_at) VALUES (?, ?, ?, ?)`,
+		activation.CorpId, activation.Success, activation.Error, unixTime(activation.CreatedAt))
+	return
+}
+
+func (r *SQLiteTenantRepository) Activations(corpId string) (activations []Activation, err error) {
+	rows, err := r.db.Query(`SELECT corp_id, success, error, created_at FROM tenant_activations
+		WHERE ? = '' OR corp_id = ? ORDER BY id`, corpId, corpId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	activations = []Activation{}
+	for rows.Next() {
+		var activation Activation
+		var createdAt int64
+		if err = rows.Scan(&activation.CorpId, &activation.Success, &activation.Error, &createdAt); err != nil {
+			return
+		}
+		activation.CreatedAt = fromUnix(createdAt)
+		activations = append(activations, activation)
+	}
+	return activations, rows.Err()
+}
+
+func (r *SQLiteTenantRepository) AddAudit(audit TenantAudit) (err error) {
+	_, err = r.db.Exec(`INSERT INTO tenant_audits (corp_id, event_type, from_status, to_status, detail, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		audit.CorpId, audit.EventType, audit.FromStatus, audit.ToStatus, audit.Detail, unixTime(audit.CreatedAt))
+	return
+}
+
+func (r *SQLiteTenantRepository) Audits(corpId string) (audits []TenantAudit, err error) {
+	rows, err := r.db.Query(`SELECT corp_id, event_type, from_status, to_status, detail, created_at FROM tenant_audits
+		WHERE ? = '' OR corp_id = ? ORDER BY id`, corpId, corpId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	audits = []TenantAudit{}
+	for rows.Next() {
+		var audit TenantAudit
+		var createdAt int64
+		if err = rows.Scan(&audit.CorpId, &audit.EventType, &audit.FromStatus, &audit.ToStatus, &audit.Detail, &createdAt); err != nil {
+			return
+		}
+		audit.CreatedAt = fromUnix(createdAt)
+		audits = append(audits, audit)
+	}
+	return audits, rows.Err()
+}
+
+func (r *SQLiteTenantRepository) SaveOrder(order Order) (err error) {
+	_, err = r.db.Exec(`INSERT OR REPLACE INTO tenant_orders (order_id, corp_id, goods_code, item_code, item_name, sub_quantity,
+		max_of_people, pay_fee, paid_time, service_start_time, service_stop_time, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		order.OrderId, order.CorpId, order.GoodsCode, order.ItemCode, order.ItemName, order.SubQuantity,
+		order.MaxOfPeople, order.PayFee, unixTime(order.PaidTime), unixTime(order.ServiceStartTime),
+		unixTime(order.ServiceStopTime), unixTime(order.CreatedAt))
+	return
+}
+
+func (r *SQLiteTenantRepository) Orders(corpId string) (orders []Order, err error) {
+	rows, err := r.db.Query(`SELECT order_id, corp_id, goods_code, item_code, item_name, sub_quantity, max_of_people, pay_fee,
+		paid_time, service_start_time, service_stop_time, created_at FROM tenant_orders WHERE corp_id = ? ORDER BY paid_time`, corpId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	orders = []Order{}
+	for rows.Next() {
+		var order Order
+		var paidTime, startTime, stopTime, createdAt int64
+		err = rows.Scan(&order.OrderId, &order.CorpId, &order.GoodsCode, &order.ItemCode, &order.ItemName, &order.SubQuantity,
+			&order.MaxOfPeople, &order.PayFee, &paidTime, &startTime, &stopTime, &createdAt)
+		if err != nil {
+			return
+		}
+		order.PaidTime = fromUnix(paidTime)
+		order.ServiceStartTime = fromUnix(startTime)
+		order.ServiceStopTime = fromUnix(stopTime)
+		order.CreatedAt = fromUnix(createdAt)
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+func (r *SQLiteTenantRepository) SaveEntitlement(entitlement Entitlement) (err error) {
+	_, err = r.db.Exec(`INSERT OR REPLACE INTO tenant_entitlements (corp_id, goods_code, item_code, item_name, max_of_people,
+		order_id, paid_time, service_stop_time, status, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entitlement.CorpId, entitlement.GoodsCode, entitlement.ItemCode, entitlement.ItemName, entitlement.MaxOfPeople,
+		entitlement.OrderId, unixTime(entitlement.PaidTime), unixTime(entitlement.ServiceStopTime), entitlement.Status, time.Now().Unix())
+	return
+}
+
+const entitlementColumns = `corp_id, goods_code, item_code, item_name, max_of_people, order_id, paid_time, service_stop_time, status, updated_at`
+
+func scanEntitlement(row interface{ Scan(...interface{}) error }) (entitlement Entitlement, err error) {
+	var paidTime, stopTime, updatedAt int64
+	err = row.Scan(&entitlement.CorpId, &entitlement.GoodsCode, &entitlement.ItemCode, &entitlement.ItemName, &entitlement.MaxOfPeople,
+		&entitlement.OrderId, &paidTime, &stopTime, &entitlement.Status, &updatedAt)
+	if err != nil {
+		return
+	}
+	entitlement.PaidTime = fromUnix(paidTime)
+	entitlement.ServiceStopTime = fromUnix(stopTime)
+	entitlement.UpdatedAt = fromUnix(updatedAt)
+	return
+}
+
+func (r *SQLiteTenantRepository) Entitlement(corpId string, goodsCode string) (entitlement Entitlement, err error) {
+	entitlement, err = scanEntitlement(r.db.QueryRow(`SELECT `+entitlementColumns+` FROM tenant_entitlements
+		WHERE corp_id = ? AND goods_code = ?`, corpId, goodsCode))
+	if err == sql.ErrNoRows {
+		err = ErrNoEntitlement
+	}
+	return
+}
+
+func (r *SQLiteTenantRepository) Entitlements(corpId string) (entitlements []Entitlement, err error) {
+	rows, err := r.db.Query(`SELECT `+entitlementColumns+` FROM tenant_entitlements WHERE corp_id = ? ORDER BY goods_code`, corpId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	entitlements = []Entitlement{}
+	for rows.Next() {
+		entitlement, err := scanEntitlement(rows)
+		if err != nil {
+			return nil, err
+		}
+		entitlements = append(entitlements, entitlement)
+	}
+	return entitlements, rows.Err()
+}
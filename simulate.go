@@ -0,0 +1,232 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 模拟事件参数
+type simulateOptions struct {
+	CorpId            string
+	UserIds           []string
+	DeptIds           []int64
+	ChatId            string
+	ProcessInstanceId string
+	ProcessCode       string
+	Type              string
+	Result            string
+}
+
+func splitComma(value string) (items []string) {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+// 按事件类型构造与钉钉推送一致的事件 json
+func simulatedEvent(eventType string, opts simulateOptions) ([]byte, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	header := EventHeader{
+		EventType: eventType,
+		TimeStamp: json.Number(strconv.FormatInt(now, 10)),
+		CorpId:    opts.CorpId,
+	}
+
+	switch {
+	case strings.HasPrefix(eventType, "user_"), strings.HasPrefix(eventType, "org_admin_"):
+		return json.Marshal(UserEvent{EventHeader: header, UserId: opts.UserIds})
+	case strings.HasPrefix(eventType, "org_dept_"):
+		return json.Marshal(DeptEvent{EventHeader: header, DeptId: opts.DeptIds})
+	case strings.HasPrefix(eventType, "chat_"):
+		evt := ChatEvent{EventHeader: header, ChatId: opts.ChatId, UserId: opts.UserIds}
+		if len(opts.UserIds) > 0 {
+			evt.Operator = opts.UserIds[0]
+		}
+		return json.Marshal(evt)
+	case eventType == "bpms_instance_change":
+		evt := BpmsInstanceChangeEvent{
+			EventHeader:       header,
+			ProcessInstanceId: opts.ProcessInstanceId,
+			ProcessCode:       opts.ProcessCode,
+			Title:             "simulated approval",
+			Type:              opts.Type,
+			CreateTime:        now,
+		}
+		if opts.Type != "start" {
+			evt.Result = opts.Result
+			evt.FinishTime = now
+		}
+		if len(opts.UserIds) > 0 {
+			evt.StaffId = opts.UserIds[0]
+		}
+		return json.Marshal(evt)
+	case eventType == "bpms_task_change":
+		evt := BpmsTaskChangeEvent{
+			EventHeader:       header,
+			ProcessInstanceId: opts.ProcessInstanceId,
+			ProcessCode:       opts.ProcessCode,
+			Title:             "simulated approval",
+			Type:              opts.Type,
+			CreateTime:        now,
+		}
+		if opts.Type != "start" {
+			evt.Result = opts.Result
+			evt.FinishTime = now
+		}
+		if len(opts.UserIds) > 0 {
+			evt.StaffId = opts.UserIds[0]
+		}
+		return json.Marshal(evt)
+	case eventType == "attendance_check_record":
+		var dataList []map[string]interface{}
+		for _, userId := range opts.UserIds {
+			dataList = append(dataList, map[string]interface{}{
+				"bizId":          strconv.FormatInt(now, 10),
+				"corpId":         opts.CorpId,
+				"userId":         userId,
+				"checkTime":      now,
+				"address":        "simulated",
+				"locationMethod": "MAP",
+			})
+		}
+		return json.Marshal(map[string]interface{}{
+			"EventType": header.EventType,
+			"TimeStamp": header.TimeStamp,
+			"CorpId":    header.CorpId,
+			"DataList":  dataList,
+		})
+	default:
+		return json.Marshal(header)
+	}
+}
+
+// dingding-demo simulate-event <event_type> [--app=hr] [--userid=a,b] [--deptid=1,2] ...
+// 按 .env 中该应用的 TOKEN/EncodingAESKey/AppKey 加密签名后 POST 到本地回调地址，并校验加密的 success 响应
+func simulateEventCommand(args []string) (err error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New("usage: simulate-event <event_type> [flags]")
+	}
+	eventType := args[0]
+
+	flags := flag.NewFlagSet("simulate-event", flag.ContinueOnError)
+	appName := flags.String("app", DefaultCallbackApp, "callback app name")
+	target := flags.String("url", "", "callback url, default http://<LISTEN>/api/dingding/callback[/<app>]")
+	corpId := flags.String("corpid", DingConfig["CorpId"], "corp id")
+	userIds := flags.String("userid", "", "comma separated user ids")
+	deptIds := flags.String("deptid", "", "comma separated department ids")
+	chatId := flags.String("chatid", "", "chat id")
+	processInstanceId := flags.String("process-instance-id", "", "approval process instance id")
+	processCode := flags.String("process-code", "", "approval process code")
+	typ := flags.String("type", "start", "bpms event type: start / finish / terminate / cancel")
+	result := flags.String("result", "agree", "bpms result: agree / refuse")
+	if err = flags.Parse(args[1:]); err != nil {
+		return
+	}
+
+	app, ok := loadCallbackApps()[*appName]
+	if !ok {
+		return fmt.Errorf("callback app %q not configured", *appName)
+	}
+	if len(*target) == 0 {
+		*target = "http://" + viper.GetString("LISTEN") + "/api/dingding/callback"
+		if app.Name != DefaultCallbackApp {
+			*target += "/" + app.Name
+		}
+	}
+
+	opts := simulateOptions{
+		CorpId:            *corpId,
+		UserIds:           splitComma(*userIds),
+		ChatId:            *chatId,
+		ProcessInstanceId: *processInstanceId,
+		ProcessCode:       *processCode,
+		Type:              *typ,
+		Result:            *result,
+	}
+	for _, id := range splitComma(*deptIds) {
+		deptId, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid deptid %q", id)
+		}
+		opts.DeptIds = append(opts.DeptIds, deptId)
+	}
+
+	payload, err := simulatedEvent(eventType, opts)
+	if err != nil {
+		return
+	}
+	fmt.Println(string(payload))
+
+	// 加密 & 签名
+	dingCrypto := app.Crypto()
+	encryptMsg := dingCrypto.GetEncryptMsg(string(payload))
+
+	body, err := json.Marshal(map[string]string{"encrypt": encryptMsg["encrypt"]})
+	if err != nil {
+		return
+	}
+
+	params := url.Values{}
+	params.Add("signature", encryptMsg["msg_signature"])
+	params.Add("timestamp", encryptMsg["timeStamp"])
+	params.Add("nonce", encryptMsg["nonce"])
+
+	resp, err := http.Post(*target+"?"+params.Encode(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("callback responded %d: %s", resp.StatusCode, data)
+	}
+
+	// 解密响应，期望为 success
+	reply := map[string]string{}
+	if err = json.Unmarshal(data, &reply); err != nil {
+		return fmt.Errorf("callback response %s: %w", data, err)
+	}
+	plain, err := dingCrypto.GetDecryptMsg(reply["timeStamp"], reply["nonce"], reply["msg_signature"], reply["encrypt"])
+	if err != nil {
+		return fmt.Errorf("decrypt callback response: %w", err)
+	}
+	if string(plain) != "success" {
+		return fmt.Errorf("callback responded %q, want success", plain)
+	}
+
+	fmt.Println("success")
+	return
+}
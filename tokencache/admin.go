@@ -0,0 +1,104 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuth 管理接口鉴权：Authorization: Bearer <token>，token 为空时管理接口不可用
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !adminAuthorized(token, c.GetHeader("Authorization")) {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+func adminAuthorized(token, auth string) bool {
+	return len(token) > 0 && subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) == 1
+}
+
+// Admin token 管理接口，由应用挂载到已鉴权的路由组下
+type Admin struct {
+	Refresher *Refresher
+	Audit     *AuditLog
+}
+
+func NewAdmin(refresher *Refresher, audit *AuditLog) *Admin {
+	return &Admin{Refresher: refresher, Audit: audit}
+}
+
+// RegisterRoutes
+// GET  /tokens                              token 列表
+// POST /tokens/refresh?name=&id=&reason=    强制刷新
+// GET  /tokens/audits?name=&id=             强制刷新记录
+func (a *Admin) RegisterRoutes(router gin.IRoutes) {
+	router.GET("/tokens", a.Tokens)
+	router.POST("/tokens/refresh", a.Refresh)
+	router.GET("/tokens/audits", a.Audits)
+}
+
+func (a *Admin) Tokens(c *gin.Context) {
+	c.JSON(http.StatusOK, a.Refresher.Tokens())
+}
+
+func (a *Admin) Refresh(c *gin.Context) {
+	name, id := c.Query("name"), c.Query("id")
+	atm, ok := a.Refresher.Lookup(name, id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "token manager not found"})
+		return
+	}
+
+	audit := TokenAudit{Name: name, Id: id, Operator: c.ClientIP(), Reason: c.Query("reason")}
+	err := a.Refresher.Refresh(atm)
+	if err == nil {
+		if expiresAt := a.Refresher.ExpiresAt(atm); !expiresAt.IsZero() {
+			audit.ExpiresAt = &expiresAt
+		}
+	} else {
+		audit.Error = err.Error()
+	}
+	// 刷新已经发生，写记录失败不影响响应
+	if auditErr := a.Audit.Append(audit); auditErr != nil {
+		log.Println(auditErr)
+	}
+
+	if err == ErrRefreshInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": name, "id": id, "expires_at": audit.ExpiresAt})
+}
+
+func (a *Admin) Audits(c *gin.Context) {
+	audits, err := a.Audit.List(c.Query("name"), c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, audits)
+}
@@ -0,0 +1,37 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import "testing"
+
+func TestAdminAuthorized(t *testing.T) {
+	cases := []struct {
+		token, auth string
+		want        bool
+	}{
+		{"secret", "Bearer secret", true},
+		{"secret", "Bearer wrong", false},
+		{"secret", "secret", false},
+		{"secret", "", false},
+		// 未配置 token 时管理接口不可用
+		{"", "Bearer ", false},
+		{"", "", false},
+	}
+	for _, tc := range cases {
+		if got := adminAuthorized(tc.token, tc.auth); got != tc.want {
+			t.Errorf("adminAuthorized(%q, %q) = %v, want %v", tc.token, tc.auth, got, tc.want)
+		}
+	}
+}
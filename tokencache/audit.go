@@ -0,0 +1,108 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TokenAudit 强制刷新记录
+type TokenAudit struct {
+	Time      time.Time  `json:"time"`
+	Name      string     `json:"name"`
+	Id        string     `json:"id"`
+	Operator  string     `json:"operator"` // 调用方 IP
+	Reason    string     `json:"reason,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// AuditLog 每行一条 JSON，文件权限 0600
+type AuditLog struct {
+	path string
+
+	mu sync.Mutex
+}
+
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path}
+}
+
+// AuditLogFromConfig 按 .env 的 TokenAuditFile 创建
+func AuditLogFromConfig() *AuditLog {
+	viper.SetDefault("TokenAuditFile", "token_audit.log")
+	return NewAuditLog(viper.GetString("TokenAuditFile"))
+}
+
+// Append 追加记录，同时输出到日志
+func (l *AuditLog) Append(audit TokenAudit) error {
+	if audit.Time.IsZero() {
+		audit.Time = time.Now()
+	}
+	data, err := json.Marshal(audit)
+	if err != nil {
+		return err
+	}
+	log.Printf("token audit: %s", data)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// List 按 Name、Id 过滤，为空时不过滤
+func (l *AuditLog) List(name string, id string) (audits []TokenAudit, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	audits = []TokenAudit{}
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return audits, nil
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var audit TokenAudit
+		if json.Unmarshal(scanner.Bytes(), &audit) != nil {
+			continue
+		}
+		if (len(name) > 0 && audit.Name != name) || (len(id) > 0 && audit.Id != id) {
+			continue
+		}
+		audits = append(audits, audit)
+	}
+	return audits, scanner.Err()
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/faabiosr/cachego"
+)
+
+// ErrTamperedEntry 缓存内容无法解密：被篡改或使用了不同的密钥
+var ErrTamperedEntry = errors.New("tampered cache entry")
+
+// EncryptedCache 使用 AES-GCM 加密缓存内容，可直接作为 DefaultAccessTokenManager 的 Cache
+// key 作为附加数据参与认证，不同 key 之间互换内容同样会被拒绝
+type EncryptedCache struct {
+	cache cachego.Cache
+	aead  cipher.AEAD
+}
+
+// NewEncryptedCache key 为 32 字节（AES-256）
+func NewEncryptedCache(cache cachego.Cache, key []byte) (*EncryptedCache, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("token cache key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedCache{cache: cache, aead: aead}, nil
+}
+
+// ParseKey 解析 base64 编码的密钥，可用 `openssl rand -base64 32` 生成
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("token cache key: %w", err)
+	}
+	return key, nil
+}
+
+// Unwrap 底层缓存
+func (c *EncryptedCache) Unwrap() cachego.Cache {
+	return c.cache
+}
+
+func (c *EncryptedCache) seal(key string, value string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), []byte(key))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (c *EncryptedCache) open(key string, entry string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(entry)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", ErrTamperedEntry
+	}
+
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	value, err := c.aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return "", ErrTamperedEntry
+	}
+	return string(value), nil
+}
+
+func (c *EncryptedCache) Contains(key string) bool {
+	return c.cache.Contains(key)
+}
+
+func (c *EncryptedCache) Delete(key string) error {
+	return c.cache.Delete(key)
+}
+
+// Fetch 无法解密的内容视为不存在并删除，管理器会重新获取 token
+func (c *EncryptedCache) Fetch(key string) (string, error) {
+	entry, err := c.cache.Fetch(key)
+	if err != nil {
+		return "", err
+	}
+
+	value, err := c.open(key, entry)
+	if err != nil {
+		_ = c.cache.Delete(key)
+		return "", err
+	}
+	return value, nil
+}
+
+func (c *EncryptedCache) FetchMulti(keys []string) map[string]string {
+	result := map[string]string{}
+	for key, entry := range c.cache.FetchMulti(keys) {
+		if value, err := c.open(key, entry); err == nil {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+func (c *EncryptedCache) Flush() error {
+	return c.cache.Flush()
+}
+
+func (c *EncryptedCache) Save(key string, value string, lifeTime time.Duration) error {
+	entry, err := c.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return c.cache.Save(key, entry, lifeTime)
+}
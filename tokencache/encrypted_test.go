@@ -0,0 +1,106 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func newTestEncryptedCache(t *testing.T, key []byte) (*EncryptedCache, *FileCache) {
+	backend := newTestFileCache(t)
+	cache, err := NewEncryptedCache(backend, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache, backend
+}
+
+func TestEncryptedCacheRoundTrip(t *testing.T) {
+	cache, backend := newTestEncryptedCache(t, bytes.Repeat([]byte{1}, 32))
+
+	if err := cache.Save("access_token:corp", "secret-token", 0); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := backend.Fetch("access_token:corp"); raw == "secret-token" {
+		t.Fatal("token stored in plaintext")
+	}
+	if value, err := cache.Fetch("access_token:corp"); err != nil || value != "secret-token" {
+		t.Fatalf("Fetch = %q, %v", value, err)
+	}
+}
+
+func TestEncryptedCacheTampered(t *testing.T) {
+	cache, backend := newTestEncryptedCache(t, bytes.Repeat([]byte{1}, 32))
+	if err := cache.Save("k", "secret-token", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := backend.Fetch("k")
+	sealed, _ := base64.StdEncoding.DecodeString(raw)
+	sealed[len(sealed)-1] ^= 0xff
+	if err := backend.Save("k", base64.StdEncoding.EncodeToString(sealed), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cache.Fetch("k"); err != ErrTamperedEntry {
+		t.Fatalf("Fetch err = %v, want ErrTamperedEntry", err)
+	}
+	// 被篡改的内容会被删除
+	if backend.Contains("k") {
+		t.Fatal("tampered entry not deleted")
+	}
+}
+
+// 密文在不同 key 之间互换同样会被拒绝
+func TestEncryptedCacheSwappedKey(t *testing.T) {
+	cache, backend := newTestEncryptedCache(t, bytes.Repeat([]byte{1}, 32))
+	if err := cache.Save("access_token:a", "token-a", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := backend.Fetch("access_token:a")
+	if err := backend.Save("access_token:b", raw, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Fetch("access_token:b"); err != ErrTamperedEntry {
+		t.Fatalf("Fetch err = %v, want ErrTamperedEntry", err)
+	}
+	if got := cache.FetchMulti([]string{"access_token:a", "access_token:b"}); len(got) != 1 || got["access_token:a"] != "token-a" {
+		t.Fatalf("FetchMulti = %v", got)
+	}
+}
+
+func TestEncryptedCacheWrongKey(t *testing.T) {
+	cache, backend := newTestEncryptedCache(t, bytes.Repeat([]byte{1}, 32))
+	if err := cache.Save("k", "secret-token", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := NewEncryptedCache(backend, bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Fetch("k"); err != ErrTamperedEntry {
+		t.Fatalf("Fetch err = %v, want ErrTamperedEntry", err)
+	}
+}
+
+func TestNewEncryptedCacheKeyLength(t *testing.T) {
+	if _, err := NewEncryptedCache(nil, make([]byte, 16)); err == nil {
+		t.Fatal("16-byte key accepted")
+	}
+}
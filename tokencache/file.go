@@ -0,0 +1,150 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileCache 每个 key 一个文件，目录 0700、文件 0600，只有当前用户可读
+type FileCache struct {
+	dir string
+}
+
+type fileEntry struct {
+	Value     string `json:"value"`
+	ExpiresAt int64  `json:"expires_at"` // 0 不过期
+}
+
+// NewFileCache 创建目录，已存在的目录收紧为 0700
+// 指定为系统临时目录时使用其下的子目录，不修改临时目录本身的权限
+func NewFileCache(dir string) (*FileCache, error) {
+	if filepath.Clean(dir) == filepath.Clean(os.TempDir()) {
+		dir = filepath.Join(dir, "dingding-token-cache")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileCache{dir: dir}, nil
+}
+
+// 文件名使用 key 的摘要，避免 key 中的特殊字符
+func (c *FileCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".cache")
+}
+
+func (c *FileCache) read(key string) (entry fileEntry, err error) {
+	data, err := ioutil.ReadFile(c.path(key))
+	if os.IsNotExist(err) {
+		return entry, ErrCacheMiss
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &entry); err != nil {
+		return
+	}
+	if entry.ExpiresAt > 0 && time.Now().Unix() >= entry.ExpiresAt {
+		_ = os.Remove(c.path(key))
+		return entry, ErrCacheMiss
+	}
+	return
+}
+
+func (c *FileCache) Contains(key string) bool {
+	_, err := c.read(key)
+	return err == nil
+}
+
+func (c *FileCache) Delete(key string) error {
+	err := os.Remove(c.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *FileCache) Fetch(key string) (string, error) {
+	entry, err := c.read(key)
+	return entry.Value, err
+}
+
+func (c *FileCache) FetchMulti(keys []string) map[string]string {
+	result := map[string]string{}
+	for _, key := range keys {
+		if entry, err := c.read(key); err == nil {
+			result[key] = entry.Value
+		}
+	}
+	return result
+}
+
+func (c *FileCache) Flush() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".cache") {
+			if err := os.Remove(filepath.Join(c.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Save 先写临时文件再改名，其他进程不会读到写了一半的内容
+func (c *FileCache) Save(key string, value string, lifeTime time.Duration) (err error) {
+	entry := fileEntry{Value: value}
+	if lifeTime > 0 {
+		entry.ExpiresAt = time.Now().Add(lifeTime).Unix()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	// TempFile 默认即为 0600，显式设置以防被修改
+	if err = tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
@@ -0,0 +1,338 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/faabiosr/cachego"
+	bt "go.etcd.io/bbolt"
+)
+
+// Locker 刷新 token 的跨进程锁
+type Locker interface {
+	// Lock 获取锁，已被其他进程持有时返回 false；ttl 后自动释放，避免进程崩溃后死锁
+	Lock(key string, ttl time.Duration) (bool, error)
+	Unlock(key string) error
+}
+
+// NewLocker 按缓存后端选择锁：
+// Redis 使用 SET NX；文件缓存以 O_EXCL 创建锁文件；bolt 在同一个事务内检查并写入；
+// 内存缓存只在当前进程可见，使用进程内的锁
+func NewLocker(cache cachego.Cache) Locker {
+	// 锁的内容无需加密，直接使用底层缓存
+	for {
+		w, ok := cache.(interface{ Unwrap() cachego.Cache })
+		if !ok {
+			break
+		}
+		cache = w.Unwrap()
+	}
+
+	switch c := cache.(type) {
+	case *RedisCache:
+		return &redisLocker{cache: c}
+	case *FileCache:
+		return &fileLocker{dir: c.dir}
+	case *boltCache:
+		return &boltLocker{db: c.db}
+	}
+	return &memoryLocker{locks: map[string]lockEntry{}}
+}
+
+func newOwner() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// lockEntry 锁的持有者及过期时间
+type lockEntry struct {
+	Owner     string `json:"owner"`
+	ExpiresAt int64  `json:"expires_at"` // UnixNano
+}
+
+func newLockEntry(ttl time.Duration) lockEntry {
+	return lockEntry{Owner: newOwner(), ExpiresAt: time.Now().Add(ttl).UnixNano()}
+}
+
+func (e lockEntry) expired() bool {
+	return time.Now().UnixNano() >= e.ExpiresAt
+}
+
+// ownerSet 记录本进程持有的锁，Unlock 时只释放自己的锁
+type ownerSet struct {
+	mu     sync.Mutex
+	owners map[string]string
+}
+
+func (s *ownerSet) set(key, owner string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owners == nil {
+		s.owners = map[string]string{}
+	}
+	s.owners[key] = owner
+}
+
+func (s *ownerSet) take(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owner, ok := s.owners[key]
+	delete(s.owners, key)
+	return owner, ok
+}
+
+type redisLocker struct {
+	cache  *RedisCache
+	owners ownerSet
+}
+
+func (l *redisLocker) Lock(key string, ttl time.Duration) (bool, error) {
+	owner := newOwner()
+	ok, err := l.cache.client.SetNX(context.Background(), l.cache.prefix+key, owner, ttl).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+	l.owners.set(key, owner)
+	return true, nil
+}
+
+// Unlock 只释放自己持有的锁
+func (l *redisLocker) Unlock(key string) error {
+	owner, ok := l.owners.take(key)
+	if !ok {
+		return nil
+	}
+
+	const script = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+	return l.cache.client.Eval(context.Background(), script, []string{l.cache.prefix + key}, owner).Err()
+}
+
+// fileLocker 以 O_CREATE|O_EXCL 创建锁文件，同一目录下只有一个进程能创建成功
+type fileLocker struct {
+	dir    string
+	owners ownerSet
+}
+
+func (l *fileLocker) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(l.dir, hex.EncodeToString(sum[:])+".lock")
+}
+
+func (l *fileLocker) Lock(key string, ttl time.Duration) (bool, error) {
+	path := l.path(key)
+	// 第一次失败时尝试清理过期的锁，再重试一次
+	for i := 0; i < 2; i++ {
+		entry := newLockEntry(ttl)
+		ok, err := createLockFile(path, entry)
+		if err != nil || ok {
+			if ok {
+				l.owners.set(key, entry.Owner)
+			}
+			return ok, err
+		}
+		if broken, err := breakStaleLock(path, ttl); err != nil || !broken {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func createLockFile(path string, entry lockEntry) (bool, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = json.NewEncoder(f).Encode(entry)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return false, err
+	}
+	return true, nil
+}
+
+// readLockFile 读取锁文件；内容还没写完时按修改时间加 ttl 估算过期时间
+func readLockFile(path string, ttl time.Duration) (entry lockEntry, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	if json.Unmarshal(data, &entry) == nil && len(entry.Owner) > 0 {
+		return entry, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return entry, err
+	}
+	return lockEntry{ExpiresAt: info.ModTime().Add(ttl).UnixNano()}, nil
+}
+
+// breakStaleLock 删除过期的锁文件
+//
+// 检查和删除之间另一个进程可能已经清理并重新加锁，
+// 所以清理本身也要持有 .break 文件，避免误删别人刚拿到的锁
+func breakStaleLock(path string, ttl time.Duration) (bool, error) {
+	breaker := path + ".break"
+	f, err := os.OpenFile(breaker, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		// 清理者崩溃后遗留的 .break 文件
+		if info, err := os.Stat(breaker); err == nil && time.Since(info.ModTime()) > ttl {
+			_ = os.Remove(breaker)
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_ = f.Close()
+	defer os.Remove(breaker)
+
+	entry, err := readLockFile(path, ttl)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil || !entry.expired() {
+		return false, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// Unlock 只删除自己创建的锁文件
+func (l *fileLocker) Unlock(key string) error {
+	owner, ok := l.owners.take(key)
+	if !ok {
+		return nil
+	}
+
+	path := l.path(key)
+	entry, err := readLockFile(path, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || entry.Owner != owner {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// boltCache 保留数据库句柄，供 boltLocker 在事务内加锁
+type boltCache struct {
+	cachego.Cache
+	db *bt.DB
+}
+
+var boltLockBucket = []byte("tokencache_locks")
+
+// boltLocker 在同一个 Update 事务内检查并写入持有者
+type boltLocker struct {
+	db     *bt.DB
+	owners ownerSet
+}
+
+func (l *boltLocker) Lock(key string, ttl time.Duration) (bool, error) {
+	entry := newLockEntry(ttl)
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return false, err
+	}
+
+	locked := false
+	err = l.db.Update(func(tx *bt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltLockBucket)
+		if err != nil {
+			return err
+		}
+		var current lockEntry
+		if data := b.Get([]byte(key)); data != nil && json.Unmarshal(data, &current) == nil && !current.expired() {
+			return nil
+		}
+		locked = true
+		return b.Put([]byte(key), value)
+	})
+	if err != nil || !locked {
+		return false, err
+	}
+	l.owners.set(key, entry.Owner)
+	return true, nil
+}
+
+func (l *boltLocker) Unlock(key string) error {
+	owner, ok := l.owners.take(key)
+	if !ok {
+		return nil
+	}
+
+	return l.db.Update(func(tx *bt.Tx) error {
+		b := tx.Bucket(boltLockBucket)
+		if b == nil {
+			return nil
+		}
+		var current lockEntry
+		if data := b.Get([]byte(key)); data == nil || json.Unmarshal(data, &current) != nil || current.Owner != owner {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// memoryLocker 进程内的锁，用于只在当前进程可见的内存缓存
+type memoryLocker struct {
+	mu    sync.Mutex
+	locks map[string]lockEntry
+}
+
+func (l *memoryLocker) Lock(key string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if current, ok := l.locks[key]; ok && !current.expired() {
+		return false, nil
+	}
+	l.locks[key] = newLockEntry(ttl)
+	return true, nil
+}
+
+func (l *memoryLocker) Unlock(key string) error {
+	l.mu.Lock()
+	delete(l.locks, key)
+	l.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestFileCache(t *testing.T) *FileCache {
+	dir, err := ioutil.TempDir("", "tokencache-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	cache, err := NewFileCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+// 多个 locker 模拟多个进程，同一时间只能有一个持有锁
+func TestFileLockerExclusion(t *testing.T) {
+	cache := newTestFileCache(t)
+
+	var holders, acquired int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			locker := NewLocker(cache)
+			for j := 0; j < 50; j++ {
+				ok, err := locker.Lock("refresh_lock", time.Minute)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !ok {
+					continue
+				}
+				if n := atomic.AddInt32(&holders, 1); n != 1 {
+					t.Errorf("%d holders at once", n)
+				}
+				atomic.AddInt32(&acquired, 1)
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+				if err := locker.Unlock("refresh_lock"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired == 0 {
+		t.Fatal("lock never acquired")
+	}
+}
+
+func TestFileLockerExpired(t *testing.T) {
+	cache := newTestFileCache(t)
+	a, b := NewLocker(cache), NewLocker(cache)
+
+	if ok, err := a.Lock("k", 50*time.Millisecond); err != nil || !ok {
+		t.Fatalf("a.Lock = %v, %v", ok, err)
+	}
+	if ok, _ := b.Lock("k", time.Minute); ok {
+		t.Fatal("b acquired a held lock")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, err := b.Lock("k", time.Minute); err != nil || !ok {
+		t.Fatalf("b.Lock after expiry = %v, %v", ok, err)
+	}
+
+	// a 的锁已被接管，a 释放时不能删除 b 的锁
+	if err := a.Unlock("k"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := a.Lock("k", time.Minute); ok {
+		t.Fatal("a.Unlock released b's lock")
+	}
+	if err := b.Unlock("k"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := a.Lock("k", time.Minute); err != nil || !ok {
+		t.Fatalf("a.Lock after b.Unlock = %v, %v", ok, err)
+	}
+}
+
+func TestMemoryLocker(t *testing.T) {
+	locker := NewLocker(nil)
+	if ok, _ := locker.Lock("k", time.Minute); !ok {
+		t.Fatal("first Lock failed")
+	}
+	if ok, _ := locker.Lock("k", time.Minute); ok {
+		t.Fatal("second Lock succeeded")
+	}
+	if err := locker.Unlock("k"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := locker.Lock("k", time.Minute); !ok {
+		t.Fatal("Lock after Unlock failed")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrCacheMiss 缓存中不存在
+var ErrCacheMiss = errors.New("cache miss")
+
+// RedisCache cachego.Cache 的 Redis 实现，key 统一加前缀，与其他数据共用一个库也不会冲突
+type RedisCache struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisCache(client *redis.Client, prefix string) *RedisCache {
+	return &RedisCache{client: client, prefix: prefix}
+}
+
+func (c *RedisCache) Contains(key string) bool {
+	n, err := c.client.Exists(context.Background(), c.prefix+key).Result()
+	return err == nil && n > 0
+}
+
+func (c *RedisCache) Delete(key string) error {
+	return c.client.Del(context.Background(), c.prefix+key).Err()
+}
+
+func (c *RedisCache) Fetch(key string) (string, error) {
+	value, err := c.client.Get(context.Background(), c.prefix+key).Result()
+	if err == redis.Nil {
+		return "", ErrCacheMiss
+	}
+	return value, err
+}
+
+func (c *RedisCache) FetchMulti(keys []string) map[string]string {
+	result := map[string]string{}
+	if len(keys) == 0 {
+		return result
+	}
+
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = c.prefix + key
+	}
+
+	values, err := c.client.MGet(context.Background(), prefixed...).Result()
+	if err != nil {
+		return result
+	}
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			result[keys[i]] = s
+		}
+	}
+	return result
+}
+
+// Flush 只删除带前缀的 key
+func (c *RedisCache) Flush() error {
+	const script = `
+local keys = redis.call('KEYS', ARGV[1])
+for i = 1, #keys, 500 do
+	redis.call('DEL', unpack(keys, i, math.min(i + 499, #keys)))
+end
+return #keys`
+	return c.client.Eval(context.Background(), script, nil, c.prefix+"*").Err()
+}
+
+// Save lifeTime 为 0 时不过期
+func (c *RedisCache) Save(key string, value string, lifeTime time.Duration) error {
+	return c.client.Set(context.Background(), c.prefix+key, value, lifeTime).Err()
+}
@@ -0,0 +1,405 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faabiosr/cachego"
+	"github.com/fastwego/dingding"
+	"github.com/spf13/viper"
+)
+
+// ErrRefreshInProgress 其他进程正在刷新
+var ErrRefreshInProgress = errors.New("refresh in progress")
+
+// 过期时间、获取时间元数据的 key 后缀，与 token 写在同一个缓存中，各进程都能看到
+const (
+	expiresAtSuffix = ":expires_at"
+	savedAtSuffix   = ":saved_at"
+)
+
+// TrackedCache 记录 token 管理器读写的 key，并在写入时同步保存过期时间
+type TrackedCache struct {
+	cachego.Cache
+
+	mu  sync.Mutex
+	key string
+}
+
+// Key token 的缓存 key，管理器尚未读写过时为空
+func (c *TrackedCache) Key() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.key
+}
+
+func (c *TrackedCache) track(key string) {
+	c.mu.Lock()
+	c.key = key
+	c.mu.Unlock()
+}
+
+func (c *TrackedCache) Fetch(key string) (string, error) {
+	c.track(key)
+	return c.Cache.Fetch(key)
+}
+
+func (c *TrackedCache) Save(key string, value string, lifeTime time.Duration) error {
+	c.track(key)
+	if err := c.Cache.Save(key, value, lifeTime); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := c.Cache.Save(key+savedAtSuffix, strconv.FormatInt(now.Unix(), 10), lifeTime); err != nil {
+		return err
+	}
+	return c.Cache.Save(key+expiresAtSuffix, strconv.FormatInt(now.Add(lifeTime).Unix(), 10), lifeTime)
+}
+
+func (c *TrackedCache) Delete(key string) error {
+	_ = c.Cache.Delete(key + expiresAtSuffix)
+	_ = c.Cache.Delete(key + savedAtSuffix)
+	return c.Cache.Delete(key)
+}
+
+// ExpiresAt token 的过期时间，未知时为零值
+func (c *TrackedCache) ExpiresAt() time.Time {
+	return c.fetchTime(expiresAtSuffix)
+}
+
+// SavedAt token 的获取时间，未知时为零值
+func (c *TrackedCache) SavedAt() time.Time {
+	return c.fetchTime(savedAtSuffix)
+}
+
+// Token 缓存中的 token，不记录 key
+func (c *TrackedCache) Token() (string, error) {
+	key := c.Key()
+	if len(key) == 0 {
+		return "", ErrCacheMiss
+	}
+	return c.Cache.Fetch(key)
+}
+
+func (c *TrackedCache) fetchTime(suffix string) time.Time {
+	key := c.Key()
+	if len(key) == 0 {
+		return time.Time{}
+	}
+
+	value, err := c.Cache.Fetch(key + suffix)
+	if err != nil {
+		return time.Time{}
+	}
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// ManagerCacheKey DefaultAccessTokenManager 缓存 token 使用的 key，与 dingding 包的实现一致
+// 用于删除其他进程或重启前缓存的 token，此时 TrackedCache 尚未记录 key
+func ManagerCacheKey(atm *dingding.DefaultAccessTokenManager) string {
+	return "access_token:" + atm.Id
+}
+
+// Purge 删除 token 及其过期时间、获取时间
+func Purge(cache cachego.Cache, key string) error {
+	for _, k := range []string{key + expiresAtSuffix, key + savedAtSuffix, key} {
+		if err := cache.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refresher 在 token 过期前后台刷新，多个进程通过共享缓存中的锁保证同一时间只有一个在刷新
+// 新 token 获取成功后才覆盖旧值，刷新期间调用方继续使用旧 token
+type Refresher struct {
+	// 剩余有效期小于 Before 时刷新
+	Before time.Duration
+	// 检查间隔
+	Interval time.Duration
+	// 锁的有效期，超过后自动释放
+	LockTTL time.Duration
+
+	HTTPClient *http.Client
+	Locker     Locker
+	// 缓存后端，同一应用的其他管理器可共用
+	Cache cachego.Cache
+
+	mu       sync.Mutex
+	managers map[*dingding.DefaultAccessTokenManager]*TrackedCache
+}
+
+func NewRefresher(cache cachego.Cache) *Refresher {
+	return &Refresher{
+		Before:     10 * time.Minute,
+		Interval:   time.Minute,
+		LockTTL:    30 * time.Second,
+		HTTPClient: http.DefaultClient,
+		Locker:     NewLocker(cache),
+		Cache:      cache,
+		managers:   map[*dingding.DefaultAccessTokenManager]*TrackedCache{},
+	}
+}
+
+// RefresherFromConfig 按 .env 配置创建，TokenRefreshBefore / TokenRefreshInterval 为 Go duration 格式
+func RefresherFromConfig(cache cachego.Cache) *Refresher {
+	r := NewRefresher(cache)
+	if d, err := time.ParseDuration(viper.GetString("TokenRefreshBefore")); err == nil && d > 0 {
+		r.Before = d
+	}
+	if d, err := time.ParseDuration(viper.GetString("TokenRefreshInterval")); err == nil && d > 0 {
+		r.Interval = d
+	}
+	return r
+}
+
+// Register 纳入后台刷新，会替换 atm.Cache 为 TrackedCache
+func (r *Refresher) Register(atm *dingding.DefaultAccessTokenManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.managers[atm]; ok {
+		return
+	}
+	tracked := &TrackedCache{Cache: atm.Cache}
+	atm.Cache = tracked
+	r.managers[atm] = tracked
+}
+
+// Unregister 停止刷新，如企业解除授权
+func (r *Refresher) Unregister(atm *dingding.DefaultAccessTokenManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.managers, atm)
+}
+
+// ExpiresAt 已注册管理器的 token 过期时间，未知时为零值
+func (r *Refresher) ExpiresAt(atm *dingding.DefaultAccessTokenManager) time.Time {
+	r.mu.Lock()
+	tracked, ok := r.managers[atm]
+	r.mu.Unlock()
+
+	if !ok {
+		return time.Time{}
+	}
+	return tracked.ExpiresAt()
+}
+
+// TokenStatus 管理接口展示的 token 状态，token 只输出首尾几位
+type TokenStatus struct {
+	Name      string     `json:"name"`
+	Id        string     `json:"id"`
+	Token     string     `json:"token"`
+	SavedAt   *time.Time `json:"saved_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Tokens 已注册管理器的 token 状态，按 Name、Id 排序
+func (r *Refresher) Tokens() []TokenStatus {
+	r.mu.Lock()
+	managers := make(map[*dingding.DefaultAccessTokenManager]*TrackedCache, len(r.managers))
+	for atm, tracked := range r.managers {
+		managers[atm] = tracked
+	}
+	r.mu.Unlock()
+
+	tokens := make([]TokenStatus, 0, len(managers))
+	for atm, tracked := range managers {
+		status := TokenStatus{Name: atm.Name, Id: atm.Id}
+		if token, err := tracked.Token(); err == nil {
+			status.Token = MaskToken(token)
+		}
+		if savedAt := tracked.SavedAt(); !savedAt.IsZero() {
+			status.SavedAt = &savedAt
+		}
+		if expiresAt := tracked.ExpiresAt(); !expiresAt.IsZero() {
+			status.ExpiresAt = &expiresAt
+		}
+		tokens = append(tokens, status)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Name != tokens[j].Name {
+			return tokens[i].Name < tokens[j].Name
+		}
+		return tokens[i].Id < tokens[j].Id
+	})
+	return tokens
+}
+
+// Lookup 按 Name、Id 查找已注册的管理器
+func (r *Refresher) Lookup(name string, id string) (*dingding.DefaultAccessTokenManager, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for atm := range r.managers {
+		if atm.Name == name && atm.Id == id {
+			return atm, true
+		}
+	}
+	return nil, false
+}
+
+// MaskToken 保留首尾各 4 位，过短时全部隐藏
+func MaskToken(token string) string {
+	if len(token) <= 12 {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:4] + strings.Repeat("*", len(token)-8) + token[len(token)-4:]
+}
+
+// Start 定时检查，ctx 取消后退出
+func (r *Refresher) Start(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.refreshExpiring()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Refresher) refreshExpiring() {
+	r.mu.Lock()
+	managers := make(map[*dingding.DefaultAccessTokenManager]*TrackedCache, len(r.managers))
+	for atm, tracked := range r.managers {
+		managers[atm] = tracked
+	}
+	r.mu.Unlock()
+
+	for atm, tracked := range managers {
+		if err := r.refreshIfExpiring(atm, tracked, false); err != nil {
+			log.Printf("refresh %s %s failed: %s", atm.Name, atm.Id, err)
+		}
+	}
+}
+
+// Refresh 立即刷新，不论剩余有效期
+func (r *Refresher) Refresh(atm *dingding.DefaultAccessTokenManager) error {
+	r.mu.Lock()
+	tracked, ok := r.managers[atm]
+	r.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%s %s not registered", atm.Name, atm.Id)
+	}
+	return r.refreshIfExpiring(atm, tracked, true)
+}
+
+func (r *Refresher) refreshIfExpiring(atm *dingding.DefaultAccessTokenManager, tracked *TrackedCache, force bool) (err error) {
+	// 管理器还没读写过缓存，先取一次得知 key
+	if len(tracked.Key()) == 0 {
+		if _, err = atm.GetAccessToken(); err != nil {
+			return
+		}
+	}
+	key := tracked.Key()
+
+	expiring := func() bool {
+		expiresAt := tracked.ExpiresAt()
+		// 过期时间未知（如升级前写入的 token）时交由管理器在过期后自行获取
+		return !expiresAt.IsZero() && time.Until(expiresAt) < r.Before
+	}
+	if !force && !expiring() {
+		return
+	}
+
+	locked, err := r.Locker.Lock(key+":refresh_lock", r.LockTTL)
+	if err != nil {
+		return
+	}
+	if !locked {
+		if force {
+			return ErrRefreshInProgress
+		}
+		return
+	}
+	defer func() {
+		if err := r.Locker.Unlock(key + ":refresh_lock"); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	// 等锁期间其他进程可能已经刷新
+	if !force && !expiring() {
+		return
+	}
+
+	token, expiresIn, err := r.fetch(atm)
+	if err != nil {
+		return
+	}
+	return tracked.Save(key, token, time.Duration(expiresIn)*time.Second)
+}
+
+// 直接调用管理器的刷新请求，响应中 token 字段与管理器 Name 一致（access_token / suite_access_token）
+func (r *Refresher) fetch(atm *dingding.DefaultAccessTokenManager) (token string, expiresIn int64, err error) {
+	resp, err := r.HTTPClient.Do(atm.GetRefreshRequestFunc())
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	result := map[string]json.RawMessage{}
+	if err = json.Unmarshal(body, &result); err != nil {
+		return
+	}
+
+	var errcode int64
+	var errmsg string
+	_ = json.Unmarshal(result["errcode"], &errcode)
+	_ = json.Unmarshal(result["errmsg"], &errmsg)
+	if errcode != 0 {
+		return "", 0, fmt.Errorf("errcode %d: %s", errcode, errmsg)
+	}
+
+	if err = json.Unmarshal(result[atm.Name], &token); err != nil || len(token) == 0 {
+		return "", 0, fmt.Errorf("no %s in response: %s", atm.Name, body)
+	}
+	if err = json.Unmarshal(result["expires_in"], &expiresIn); err != nil || expiresIn <= 0 {
+		// 钉钉 access_token 有效期 7200 秒
+		expiresIn = 7200
+	}
+	return token, expiresIn, nil
+}
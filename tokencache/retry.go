@@ -0,0 +1,185 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/fastwego/dingding"
+)
+
+// InvalidTokenErrcodes 表示 token 无效的 errcode：40014 不合法的 access_token，42001 access_token 超时
+var InvalidTokenErrcodes = map[int64]bool{
+	40014: true,
+	42001: true,
+}
+
+// RetryTransport 钉钉返回 token 无效时，使缓存失效、重新获取 token 后重放一次请求
+// 请求体会先读入内存，io.Pipe 构造的 multipart 上传同样可以重放
+type RetryTransport struct {
+	Base      http.RoundTripper
+	Manager   *dingding.DefaultAccessTokenManager
+	Refresher *Refresher
+}
+
+// RetryClient 用作 dingding.Client 的 HTTPClient，atm 需已 Register
+func (r *Refresher) RetryClient(atm *dingding.DefaultAccessTokenManager) *http.Client {
+	return &http.Client{Transport: &RetryTransport{Base: http.DefaultTransport, Manager: atm, Refresher: r}}
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, err := bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := req.URL.Query().Get(t.Manager.Name)
+	if len(stale) == 0 || !isJSON(resp) {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var result struct {
+		Errcode int64 `json:"errcode"`
+	}
+	if json.Unmarshal(body, &result) != nil || !InvalidTokenErrcodes[result.Errcode] {
+		return resp, nil
+	}
+
+	token, err := t.Refresher.Invalidate(t.Manager, stale)
+	if err != nil {
+		// 刷新失败时返回原响应，由调用方处理 errcode
+		log.Printf("invalidate %s %s failed: %s", t.Manager.Name, t.Manager.Id, err)
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	query := retry.URL.Query()
+	query.Set(t.Manager.Name, token)
+	retry.URL.RawQuery = query.Encode()
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.Base.RoundTrip(retry)
+}
+
+// 读入请求体并设置 GetBody，以便重放
+func bufferBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return req, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTripper 不应修改传入的请求
+	req = req.Clone(req.Context())
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return req, nil
+}
+
+// 只检查 JSON 响应，文件下载等直接透传
+// 钉钉部分接口以 text/plain 返回 JSON
+func isJSON(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "application/json" || mediaType == "text/plain"
+}
+
+// Invalidate token 被钉钉判定无效时调用
+// 缓存中仍是 stale 时重新获取；已被其他调用方或进程替换时直接返回新值
+func (r *Refresher) Invalidate(atm *dingding.DefaultAccessTokenManager, stale string) (token string, err error) {
+	r.mu.Lock()
+	tracked, ok := r.managers[atm]
+	r.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("%s %s not registered", atm.Name, atm.Id)
+	}
+
+	if len(tracked.Key()) == 0 {
+		if _, err = atm.GetAccessToken(); err != nil {
+			return
+		}
+	}
+
+	// 其他进程持有锁时等待其刷新完成，最长 LockTTL
+	deadline := time.Now().Add(r.LockTTL)
+	for {
+		if current, err := tracked.Token(); err == nil && current != stale {
+			return current, nil
+		}
+
+		token, locked, err := r.replace(atm, tracked, stale)
+		if err != nil || locked {
+			return token, err
+		}
+		if time.Now().After(deadline) {
+			return "", ErrRefreshInProgress
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// 加锁后重新获取，获取失败时删除无效的 token，管理器下次调用会自行获取
+func (r *Refresher) replace(atm *dingding.DefaultAccessTokenManager, tracked *TrackedCache, stale string) (token string, locked bool, err error) {
+	key := tracked.Key()
+	locked, err = r.Locker.Lock(key+":refresh_lock", r.LockTTL)
+	if err != nil || !locked {
+		return
+	}
+	defer func() {
+		if err := r.Locker.Unlock(key + ":refresh_lock"); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	if current, err := tracked.Token(); err == nil && current != stale {
+		return current, true, nil
+	}
+
+	token, expiresIn, err := r.fetch(atm)
+	if err != nil {
+		_ = tracked.Delete(key)
+		return "", true, err
+	}
+	return token, true, tracked.Save(key, token, time.Duration(expiresIn)*time.Second)
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokencache
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fastwego/dingding"
+)
+
+type retryTestServer struct {
+	*httptest.Server
+
+	token     atomic.Value
+	refreshes int32
+	mu        sync.Mutex
+	bodies    []string
+}
+
+// 模拟钉钉：/gettoken 下发新 token，/api 校验 token 后原样返回请求体
+func newRetryTestServer(t *testing.T) *retryTestServer {
+	s := &retryTestServer{}
+	s.token.Store("fresh")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gettoken", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.refreshes, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"errcode": 0, "access_token": s.token.Load(), "expires_in": 7200,
+		})
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.bodies = append(s.bodies, string(body))
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("access_token") != s.token.Load() {
+			_, _ = w.Write([]byte(`{"errcode":40014,"errmsg":"invalid access_token"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 0, "body": string(body)})
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte(`{"errcode":40014}`))
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// 注册一个缓存中已有 stale token 的管理器
+func newRetryTestManager(t *testing.T, s *retryTestServer) (*Refresher, *dingding.DefaultAccessTokenManager) {
+	cache := newTestFileCache(t)
+	atm := &dingding.DefaultAccessTokenManager{
+		Id:   "corp",
+		Name: "access_token",
+		GetRefreshRequestFunc: func() *http.Request {
+			req, _ := http.NewRequest(http.MethodGet, s.URL+"/gettoken", nil)
+			return req
+		},
+		Cache: cache,
+	}
+	r := NewRefresher(cache)
+	r.Register(atm)
+	if err := atm.Cache.Save(ManagerCacheKey(atm), "stale", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	return r, atm
+}
+
+func postPipe(t *testing.T, client *http.Client, url string, body string) map[string]interface{} {
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = io.Copy(pw, strings.NewReader(body))
+		_ = pw.Close()
+	}()
+
+	// io.Pipe 构造的请求没有 GetBody，与 multipart 上传相同
+	req, err := http.NewRequest(http.MethodPost, url, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	result := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestRetryTransportReplaysBody(t *testing.T) {
+	s := newRetryTestServer(t)
+	r, atm := newRetryTestManager(t, s)
+
+	result := postPipe(t, r.RetryClient(atm), s.URL+"/api?access_token=stale", "payload")
+	if result["errcode"] != float64(0) || result["body"] != "payload" {
+		t.Fatalf("result = %v", result)
+	}
+	if len(s.bodies) != 2 || s.bodies[0] != "payload" || s.bodies[1] != "payload" {
+		t.Fatalf("server bodies = %q", s.bodies)
+	}
+	if token, _ := atm.Cache.Fetch(ManagerCacheKey(atm)); token != "fresh" {
+		t.Fatalf("cached token = %q", token)
+	}
+}
+
+// 并发请求同时遇到 token 失效时只重新获取一次
+func TestRetryTransportConcurrentInvalidate(t *testing.T) {
+	s := newRetryTestServer(t)
+	r, atm := newRetryTestManager(t, s)
+	client := r.RetryClient(atm)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result := postPipe(t, client, s.URL+"/api?access_token=stale", "x"); result["errcode"] != float64(0) {
+				t.Errorf("result = %v", result)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&s.refreshes); n != 1 {
+		t.Fatalf("refreshed %d times", n)
+	}
+}
+
+// 非 JSON 响应直接透传，不触发刷新
+func TestRetryTransportSkipsNonJSON(t *testing.T) {
+	s := newRetryTestServer(t)
+	r, atm := newRetryTestManager(t, s)
+
+	resp, err := r.RetryClient(atm).Get(s.URL + "/file?access_token=stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt32(&s.refreshes); n != 0 {
+		t.Fatalf("refreshed %d times", n)
+	}
+}
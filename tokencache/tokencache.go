@@ -0,0 +1,132 @@
+// Copyright 2021 FastWeGo
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tokencache 各 demo 共用的 access_token 缓存，后端由 .env 中的 TokenCache 选择
+package tokencache
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/faabiosr/cachego"
+	"github.com/faabiosr/cachego/bolt"
+	"github.com/faabiosr/cachego/sync"
+	"github.com/fastwego/dingding"
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/viper"
+	bt "go.etcd.io/bbolt"
+)
+
+// Options 缓存后端参数
+type Options struct {
+	// 缓存类型：memory | file | redis | bolt
+	Kind string
+
+	// file：缓存目录
+	Dir string
+
+	// 非空时使用 AES-GCM 加密缓存内容，32 字节
+	Key []byte
+
+	// redis：兼容 Redis 协议的存储均可
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	RedisPrefix   string
+
+	// bolt：数据库文件，被打开它的进程独占，只适用于单进程部署
+	BoltPath string
+}
+
+// New 按类型创建缓存，配置了 Key 时加密
+func New(opts Options) (cachego.Cache, error) {
+	cache, err := newBackend(opts)
+	if err != nil || len(opts.Key) == 0 {
+		return cache, err
+	}
+	return NewEncryptedCache(cache, opts.Key)
+}
+
+func newBackend(opts Options) (cachego.Cache, error) {
+	switch opts.Kind {
+	case "memory":
+		// 仅当前进程可见
+		return sync.New(), nil
+	case "", "file":
+		dir := opts.Dir
+		if len(dir) == 0 {
+			dir = os.TempDir()
+		}
+		return NewFileCache(dir)
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     opts.RedisAddr,
+			Password: opts.RedisPassword,
+			DB:       opts.RedisDB,
+		})
+		return NewRedisCache(client, opts.RedisPrefix), nil
+	case "bolt":
+		db, err := bt.Open(opts.BoltPath, 0600, &bt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("open bolt %s: %w", opts.BoltPath, err)
+		}
+		return &boltCache{Cache: bolt.New(db), db: db}, nil
+	}
+	return nil, fmt.Errorf("unknown TokenCache %s", opts.Kind)
+}
+
+// FromConfig 按 .env 配置创建缓存
+func FromConfig() (cachego.Cache, error) {
+	viper.SetDefault("TokenCache", "file")
+	viper.SetDefault("TokenCacheDir", os.TempDir())
+	viper.SetDefault("TokenCachePrefix", "dingding:token:")
+	viper.SetDefault("TokenCacheBoltPath", "token_cache.db")
+
+	var key []byte
+	if encoded := viper.GetString("TokenCacheKey"); len(encoded) > 0 {
+		var err error
+		if key, err = ParseKey(encoded); err != nil {
+			return nil, err
+		}
+	}
+
+	return New(Options{
+		Kind:          viper.GetString("TokenCache"),
+		Dir:           viper.GetString("TokenCacheDir"),
+		Key:           key,
+		RedisAddr:     viper.GetString("RedisAddr"),
+		RedisPassword: viper.GetString("RedisPassword"),
+		RedisDB:       viper.GetInt("RedisDB"),
+		RedisPrefix:   viper.GetString("TokenCachePrefix"),
+		BoltPath:      viper.GetString("TokenCacheBoltPath"),
+	})
+}
+
+// Setup 按 .env 配置创建缓存交给 atm，并纳入后台刷新
+//
+// 返回的 client 用作 dingding.Client 的 HTTPClient：token 被提前吊销时重新获取并重放请求；
+// audit 记录通过管理接口强制刷新 token 的操作
+func Setup(atm *dingding.DefaultAccessTokenManager) (refresher *Refresher, audit *AuditLog, client *http.Client, err error) {
+	cache, err := FromConfig()
+	if err != nil {
+		return
+	}
+
+	atm.Cache = cache
+	refresher = RefresherFromConfig(cache)
+	refresher.Register(atm)
+	return refresher, AuditLogFromConfig(), refresher.RetryClient(atm), nil
+}
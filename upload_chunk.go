@@ -26,10 +26,18 @@ import (
 	"path"
 	"strconv"
 
+	"github.com/fastwego/dingding"
 	"github.com/gin-gonic/gin"
 )
 
-func UploadChunk(c *gin.Context) {
+// UploadChunk 分块上传文件
+func UploadChunk(client *dingding.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uploadChunk(c, client)
+	}
+}
+
+func uploadChunk(c *gin.Context, client *dingding.Client) {
 
 	// 分块最小需大于100KB，最大不超过8M，最多支持10000块。
 	uploadFile := "tmp.200k"
@@ -52,7 +60,7 @@ func UploadChunk(c *gin.Context) {
 	params.Add("chunk_numbers", "2")
 
 	req, _ := http.NewRequest(http.MethodGet, "/file/upload/transaction?"+params.Encode(), nil)
-	data, err := DingClient.Do(req)
+	data, err := client.Do(req)
 	if err != nil {
 		log.Println(err)
 		return
@@ -69,10 +77,10 @@ func UploadChunk(c *gin.Context) {
 	}
 
 	// 文件 1
-	chunk("1", tx.UploadID, uploadFile)
+	chunk(client, "1", tx.UploadID, uploadFile)
 
 	// 文件 2
-	chunk("2", tx.UploadID, uploadFile)
+	chunk(client, "2", tx.UploadID, uploadFile)
 
 	// 提交事务
 	params = url.Values{}
@@ -82,7 +90,7 @@ func UploadChunk(c *gin.Context) {
 	params.Add("upload_id", tx.UploadID)
 
 	req, _ = http.NewRequest(http.MethodGet, "/file/upload/transaction?"+params.Encode(), nil)
-	data, err = DingClient.Do(req)
+	data, err = client.Do(req)
 
 	log.Println(string(data), err)
 	if err != nil {
@@ -92,7 +100,7 @@ func UploadChunk(c *gin.Context) {
 	c.Writer.Write(data)
 }
 
-func chunk(seq string, uploadId string, uploadFile string) {
+func chunk(client *dingding.Client, seq string, uploadId string, uploadFile string) {
 	params := url.Values{}
 	params.Add("agent_id", DingConfig["AgentId"])
 	params.Add("chunk_sequence", seq)
@@ -120,7 +128,7 @@ func chunk(seq string, uploadId string, uploadFile string) {
 
 	req, _ := http.NewRequest(http.MethodPost, "/file/upload/chunk?"+params.Encode(), r)
 	req.Header.Set("Content-Type", m.FormDataContentType())
-	data, err := DingClient.Do(req)
+	data, err := client.Do(req)
 
 	fmt.Println(string(data), err)
 	if err != nil {
@@ -25,10 +25,18 @@ import (
 	"path"
 	"strconv"
 
+	"github.com/fastwego/dingding"
 	"github.com/gin-gonic/gin"
 )
 
-func UploadSingle(c *gin.Context) {
+// UploadSingle 单步上传文件
+func UploadSingle(client *dingding.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uploadSingle(c, client)
+	}
+}
+
+func uploadSingle(c *gin.Context, client *dingding.Client) {
 
 	// single upload
 	uploadFile := "qr2.png"
@@ -66,7 +74,7 @@ func UploadSingle(c *gin.Context) {
 
 	req, _ := http.NewRequest(http.MethodPost, "/file/upload/single?"+params.Encode(), r)
 	req.Header.Set("Content-Type", m.FormDataContentType())
-	resp, err := DingClient.Do(req)
+	resp, err := client.Do(req)
 
 	if err != nil {
 		log.Println(err)